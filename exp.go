@@ -4,13 +4,33 @@ import (
 	"bufio"
 	"fmt"
 	"github.com/schollz/progressbar/v3"
+	"internal/bitmap"
 	"internal/bptree"
+	"internal/buffer"
 	"internal/fs"
+	"internal/hashidx"
+	"internal/join"
+	"internal/query"
+	"internal/txn"
 	"os"
+	"time"
 )
 
 func main() {
 	runExperiment(200)
+	runClusteredExperiment(200)
+	runHashExperiment(200)
+	runBitmapExperiment(200)
+	runSortExperiment(200)
+	runJoinExperiment(200)
+	runCatalogExperiment(200)
+	runAllocExperiment(200)
+	runCompressionExperiment(200)
+	runPrefetchExperiment(200)
+	runSnapshotExperiment(200)
+	runVersionExperiment(200)
+	runTransactionExperiment(200)
+	runLockExperiment(200)
 	fmt.Print("Press 'Enter' to continue...")
 	bufio.NewReader(os.Stdin).ReadBytes('\n')
 }
@@ -18,14 +38,16 @@ func main() {
 func runExperiment(blockSize int) {
 	// Experiment 1
 	fmt.Println("Loading data from tsv...")
-	vd := fs.NewVirtualDisk(100, blockSize)
-	vd.LoadRecords("./data/data.tsv")
+	vd, err := loadDisk(100, blockSize)
+	if err != nil {
+		fmt.Printf("Error loading records: %v\n", err)
+		return
+	}
 
 	// Key: uint32 - 4 bytes
 	// Pointers: (Either to data or leaf, same size) - 8 bytes/ptr
-	// Parent: ptr to parent - 8 byte
-	// IsLeaf: bool - 1 byte
-	treeOrder := (vd.BlockSize - 5) / 12 // Branching factor, solved with x => blockSize = 12x -4 + 8 + 1
+	// Header: IsLeaf, key count and ptr to parent - 11 bytes
+	treeOrder := indexOrder(vd.BlockSize)
 	tree := bptree.New(treeOrder)
 
 	fmt.Println("Constructing tree, it will take awhile...")
@@ -35,7 +57,11 @@ func runExperiment(blockSize int) {
 		records, pointers := fs.BlockToRecords(block)
 
 		for i, record := range records {
-			tree.Insert(record.NumVotes, pointers[i])
+			err = tree.Insert(record.NumVotes, pointers[i])
+			if err != nil {
+				fmt.Printf("Error building index: %v\n", err)
+				return
+			}
 			bar.Add(1)
 		}
 	}
@@ -52,6 +78,7 @@ func runExperiment(blockSize int) {
 	fmt.Printf("Tree height: %v\n", tree.GetHeight())
 	fmt.Printf("Number of nodes: %v\n", tree.GetTotalNodes())
 	fmt.Printf("Parameter n: %v\n", tree.Order-1)
+	fmt.Printf("Node size: %db (block size: %db)\n", tree.Root.EncodedSize(), vd.BlockSize)
 
 	fmt.Println("")
 	fmt.Println("Content of root node:")
@@ -72,17 +99,22 @@ func runExperiment(blockSize int) {
 	if records != nil {
 		processDataBlock(&vd, records)
 	} else {
-		panic("No records found!")
+		fmt.Println("No records found!")
 	}
+	bruteForceScan(&vd, 500, 500)
 
 	// Experiment 4
 	fmt.Println("\n=== Experiment 4 ===")
 	records = tree.SearchRange(30000, 40000, true)
 	processDataBlock(&vd, records)
+	bruteForceScan(&vd, 30000, 40000)
 
 	// Experiment 5
 	fmt.Println("\n=== Experiment 5 ===")
-	tree.Delete(1000)
+	err = tree.Delete(1000)
+	if err != nil {
+		fmt.Printf("Error deleting key 1000: %v\n", err)
+	}
 
 	fmt.Printf("Number of times that a node is deleted: %v\n", 0)
 	fmt.Printf("Tree height: %v\n", tree.GetHeight())
@@ -101,14 +133,24 @@ func runExperiment(blockSize int) {
 	//tree.Print()
 }
 
+// Order of the index trees, so that a node fits in a block of blockSize
+func indexOrder(blockSize int) int {
+	return bptree.OrderForBlockSize(blockSize, bptree.KeySize, bptree.PtrSize, bptree.HeaderSize)
+}
+
+// Create a virtual disk of capacityMB and load the ratings from data.tsv into it
+func loadDisk(capacityMB int, blockSize int) (fs.VirtualDisk, error) {
+	vd, err := fs.NewVirtualDisk(capacityMB, blockSize)
+	if err != nil {
+		return vd, fmt.Errorf("error creating virtual disk: %w", err)
+	}
+	return vd, vd.LoadRecords("./data/data.tsv")
+}
+
 func processDataBlock(vd *fs.VirtualDisk, records []*byte) {
 	var accessedDataBlockIndexes []int
 
-	var totalAverageRating float32
 	for _, addr := range records {
-		r := fs.AddrToRecord(vd, addr)
-		totalAverageRating += r.AverageRating
-
 		loc := vd.LuTable[addr]
 		exists := false
 		for _, a := range accessedDataBlockIndexes {
@@ -131,12 +173,887 @@ func processDataBlock(vd *fs.VirtualDisk, records []*byte) {
 			fmt.Printf("\nContent in Block #%v:\n", blockIndex)
 			//fmt.Println("Raw block content:")
 			//fmt.Printf("%v\n", block.Content)
-			for j := 0; j < int(block.NumRecord); j++ {
-				fmt.Printf("%v\n", blockRecords[j])
+			for _, record := range blockRecords {
+				fmt.Printf("%v\n", record)
 			}
 		}
 	}
 
 	// Avg of average rating
-	fmt.Printf("\nAverage of averageRating: %v\n", totalAverageRating/float32(len(records)))
+	agg, err := query.AggregateAddrs(vd, records, query.ColumnAverageRating)
+	if err != nil {
+		fmt.Printf("\nError reading records: %v\n", err)
+		return
+	}
+	fmt.Printf("\nAverage of averageRating: %v\n", agg.Avg)
+}
+
+// Answer the same query without the index, as a baseline
+func bruteForceScan(vd *fs.VirtualDisk, fromKey uint32, toKey uint32) {
+	scanner := vd.Scan(func(record fs.Record) bool {
+		return record.NumVotes >= fromKey && record.NumVotes <= toKey
+	})
+
+	agg := query.AggregateScan(scanner, query.ColumnAverageRating)
+
+	fmt.Println("\nBrute-force linear scan:")
+	fmt.Printf("Number of data blocks the process accesses: %v\n", scanner.Stats.BlocksRead)
+	fmt.Printf("Number of records examined: %v, matched: %v\n", scanner.Stats.RecordsExamined, scanner.Stats.Matches)
+	fmt.Printf("Average of averageRating: %v\n", agg.Avg)
+}
+
+// Compare the data blocks accessed by the Experiment 3 and 4 queries, with records in TSV order and clustered on NumVotes
+func runClusteredExperiment(blockSize int) {
+	fmt.Println("\n=== Clustered vs unclustered ===")
+	vd, err := loadDisk(100, blockSize)
+	if err != nil {
+		fmt.Printf("Error loading records: %v\n", err)
+		return
+	}
+
+	treeOrder := indexOrder(vd.BlockSize)
+	queries := [][2]uint32{{500, 500}, {30000, 40000}}
+	var unclustered, unclusteredZones []int
+
+	table, err := query.NewTable("ratings", &vd, treeOrder)
+	if err != nil {
+		fmt.Printf("Error building index: %v\n", err)
+		return
+	}
+	for _, q := range queries {
+		unclustered = append(unclustered, countDataBlocks(&vd, table.Indexes[query.ColumnNumVotes].SearchRange(q[0], q[1], false)))
+		unclusteredZones = append(unclusteredZones, zoneScanBlocks(&vd, q[0], q[1]))
+	}
+
+	err = vd.Cluster()
+	if err != nil {
+		fmt.Printf("Error clustering records: %v\n", err)
+		return
+	}
+	table, err = query.NewTable("ratings", &vd, treeOrder)
+	if err != nil {
+		fmt.Printf("Error building index: %v\n", err)
+		return
+	}
+
+	fmt.Println("Data blocks read through the index, and by a full scan skipping blocks by their zone map")
+	fmt.Printf("%-25v %-12v %-12v %-20v %v\n", "Query", "Unclustered", "Clustered", "Unclustered zones", "Clustered zones")
+	for i, q := range queries {
+		clustered := countDataBlocks(&vd, table.Indexes[query.ColumnNumVotes].SearchRange(q[0], q[1], false))
+		name := fmt.Sprintf("numVotes %v-%v", q[0], q[1])
+		fmt.Printf("%-25v %-12v %-12v %-20v %v\n", name, unclustered[i], clustered, unclusteredZones[i], zoneScanBlocks(&vd, q[0], q[1]))
+	}
+	fmt.Printf("Total blocks: %v\n", len(vd.Blocks))
+}
+
+// Count the blocks read by a full scan for numVotes in [from, to], skipping blocks by their zone map
+func zoneScanBlocks(vd *fs.VirtualDisk, from uint32, to uint32) int {
+	scanner := vd.ScanZones(func(zone fs.ZoneMap) bool {
+		return zone.MaxNumVotes >= from && zone.MinNumVotes <= to
+	}, func(record fs.Record) bool {
+		return record.NumVotes >= from && record.NumVotes <= to
+	})
+	for scanner.Next() {
+	}
+	return scanner.Stats.BlocksRead
+}
+
+// Count the distinct data blocks holding the records
+func countDataBlocks(vd *fs.VirtualDisk, records []*byte) int {
+	accessed := map[int]bool{}
+	for _, addr := range records {
+		accessed[vd.LuTable[addr].BlockIndex] = true
+	}
+	return len(accessed)
+}
+
+// Compare point lookups on tconst through the hash index and a B+ tree keyed by the numeric part of tconst
+func runHashExperiment(blockSize int) {
+	fmt.Println("\n=== Hash index vs B+ tree on tconst ===")
+	vd, err := loadDisk(100, blockSize)
+	if err != nil {
+		fmt.Printf("Error loading records: %v\n", err)
+		return
+	}
+
+	index, err := hashidx.New(vd.BlockSize)
+	if err != nil {
+		fmt.Printf("Error creating hash index: %v\n", err)
+		return
+	}
+	tree := bptree.New(indexOrder(vd.BlockSize), bptree.WithUnique())
+
+	var tconsts []string
+	for _, block := range vd.Blocks {
+		records, pointers := fs.BlockToRecords(block)
+		for i, record := range records {
+			key, err := join.TconstKey(record.Tconst)
+			if err != nil {
+				fmt.Printf("Error parsing tconst: %v\n", err)
+				return
+			}
+			if err = index.Insert(record.Tconst, pointers[i]); err != nil {
+				fmt.Printf("Error building hash index: %v\n", err)
+				return
+			}
+			if err = tree.Insert(key, pointers[i]); err != nil {
+				fmt.Printf("Error building index: %v\n", err)
+				return
+			}
+			tconsts = append(tconsts, record.Tconst)
+		}
+	}
+
+	// Look up every 100th record, plus one tconst that doesn't exist
+	lookups := 0
+	bucketsRead, nodesRead := 0, 0
+	for i := 0; i < len(tconsts); i += 100 {
+		key, _ := join.TconstKey(tconsts[i])
+		if _, err = index.Search(tconsts[i]); err != nil {
+			fmt.Printf("Error searching hash index: %v\n", err)
+			return
+		}
+		tree.Search(key, false)
+		bucketsRead += index.BucketsAccessed
+		nodesRead += tree.NodesAccessed
+		lookups++
+	}
+	_, err = index.Search("tt9999999")
+	fmt.Printf("Missing tconst: %v, bucket pages read: %v\n", err, index.BucketsAccessed)
+
+	fmt.Printf("Lookups: %v\n", lookups)
+	fmt.Printf("%-12v %-14v %-12v %v\n", "Index", "Pages", "Pages/lookup", "Other")
+	fmt.Printf("%-12v %-14v %-12.2f global depth %v, load factor %.2f\n", "Hash", index.GetTotalBuckets(),
+		float64(bucketsRead)/float64(lookups), index.GlobalDepth, index.LoadFactor())
+	fmt.Printf("%-12v %-14v %-12.2f height %v\n", "B+ tree", tree.GetTotalNodes(),
+		float64(nodesRead)/float64(lookups), tree.GetHeight())
+}
+
+// Compare the bitmap index on averageRating with the B+ tree index, in size and in combining predicates
+func runBitmapExperiment(blockSize int) {
+	fmt.Println("\n=== Bitmap index vs B+ tree on averageRating ===")
+	vd, err := loadDisk(100, blockSize)
+	if err != nil {
+		fmt.Printf("Error loading records: %v\n", err)
+		return
+	}
+
+	table, err := query.NewTable("ratings", &vd, indexOrder(vd.BlockSize))
+	if err == nil {
+		err = table.CreateIndex(query.ColumnAverageRating)
+	}
+	if err != nil {
+		fmt.Printf("Error building index: %v\n", err)
+		return
+	}
+	index, err := bitmap.Build(&vd)
+	if err != nil {
+		fmt.Printf("Error building bitmap index: %v\n", err)
+		return
+	}
+
+	plain, compressed := index.SizeBytes()
+	// Nodes, plus the lists of 8 byte record pointers holding the duplicates of every rating
+	treeSize := table.Indexes[query.ColumnAverageRating].GetTotalNodes()*vd.BlockSize + len(vd.LuTable)*8
+	fmt.Printf("Distinct ratings: %v\n", len(index.Bitmaps))
+	fmt.Printf("B+ tree: %vb, bitmaps: %vb, WAH compressed: %vb\n", treeSize, plain, compressed)
+
+	// Ratings from the bitmaps, numVotes from the B+ tree, combined as bitmaps
+	votes := index.FromAddrs(table.Indexes[query.ColumnNumVotes].SearchRange(30000, 40000, false))
+	highRated := index.Range(8, 10)
+	perfect := index.Range(10, 10)
+	popular := index.FromAddrs(table.Indexes[query.ColumnNumVotes].SearchRange(100000, ^uint32(0), false))
+
+	queries := []struct {
+		sql    string
+		bitmap int
+	}{
+		{"SELECT COUNT(*) FROM ratings WHERE averageRating >= 8", highRated.Compress().Count()},
+		{"SELECT COUNT(*) FROM ratings WHERE averageRating >= 8 AND numVotes BETWEEN 30000 AND 40000",
+			highRated.Compress().And(votes.Compress()).Count()},
+		{"SELECT COUNT(*) FROM ratings WHERE averageRating = 10 OR numVotes >= 100000",
+			perfect.Compress().Or(popular.Compress()).Count()},
+	}
+	for _, q := range queries {
+		result, err := table.Run(q.sql)
+		if err != nil {
+			fmt.Printf("Error running query: %v\n", err)
+			return
+		}
+		fmt.Println(q.sql)
+		fmt.Printf("  bitmap: %v, B+ tree: %.0f (%v)\n", q.bitmap, result.Value, result.Plan)
+	}
+}
+
+// External merge sort of the records by every column, with different memory budgets
+func runSortExperiment(blockSize int) {
+	fmt.Println("\n=== External merge sort ===")
+	vd, err := loadDisk(100, blockSize)
+	if err != nil {
+		fmt.Printf("Error loading records: %v\n", err)
+		return
+	}
+
+	columns := []struct {
+		name string
+		less func(a fs.Record, b fs.Record) bool
+	}{
+		{query.ColumnTconst, fs.ByTconst},
+		{query.ColumnAverageRating, fs.ByAverageRating},
+		{query.ColumnNumVotes, fs.ByNumVotes},
+	}
+
+	fmt.Printf("Blocks: %v\n", len(vd.Blocks))
+	fmt.Printf("%-15v %-8v %-6v %-7v %-12v %-14v %v\n", "Column", "Buffers", "Runs", "Passes", "Blocks read", "Blocks written", "Sorted")
+	for _, column := range columns {
+		for _, buffers := range []int{3, 10, 100} {
+			sorted, stats, err := vd.ExternalSort(column.less, buffers)
+			if err != nil {
+				fmt.Printf("Error sorting records: %v\n", err)
+				return
+			}
+
+			ok := true
+			var prev *fs.Record
+			scanner := sorted.Scan(nil)
+			for scanner.Next() {
+				record := scanner.Record()
+				if prev != nil && column.less(record, *prev) {
+					ok = false
+				}
+				prev = &record
+			}
+			fmt.Printf("%-15v %-8v %-6v %-7v %-12v %-14v %v\n", column.name, buffers, stats.Runs, stats.Passes,
+				stats.BlocksRead, stats.BlocksWritten, ok)
+		}
+	}
+}
+
+// Join ratings with title.basics on tconst with every join operator
+func runJoinExperiment(blockSize int) {
+	fmt.Println("\n=== Joins with title.basics ===")
+	ratings, err := loadDisk(100, blockSize)
+	if err != nil {
+		fmt.Printf("Error loading records: %v\n", err)
+		return
+	}
+	basics, err := fs.NewVirtualDisk(500, blockSize)
+	if err != nil {
+		fmt.Printf("Error creating virtual disk: %v\n", err)
+		return
+	}
+	err = basics.LoadBasics("./data/basics.tsv")
+	if err != nil {
+		fmt.Printf("Error loading basics: %v\n", err)
+		return
+	}
+
+	hashIndex, err := join.BuildHashIndex(&basics)
+	if err != nil {
+		fmt.Printf("Error building hash index: %v\n", err)
+		return
+	}
+	tree, err := join.BuildTreeIndex(&basics, indexOrder(basics.BlockSize))
+	if err != nil {
+		fmt.Printf("Error building index: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Ratings blocks: %v, basics blocks: %v\n", len(ratings.Blocks), len(basics.Blocks))
+	fmt.Printf("%-32v %-8v %-8v %-8v %-8v %-8v %v\n", "Join", "Outer", "Inner", "Index", "Sort", "Total", "Matches")
+	report := func(name string, stats join.Stats) {
+		fmt.Printf("%-32v %-8v %-8v %-8v %-8v %-8v %v\n", name, stats.OuterBlocks, stats.InnerBlocks,
+			stats.IndexNodes, stats.SortBlocks, stats.Total(), stats.Matches)
+	}
+
+	for _, buffers := range []int{3, 10, 100} {
+		_, stats, err := join.BlockNestedLoop(&ratings, &basics, buffers)
+		if err != nil {
+			fmt.Printf("Error joining: %v\n", err)
+			return
+		}
+		report(fmt.Sprintf("Block nested-loop (%v buffers)", buffers), stats)
+	}
+
+	_, stats, err := join.IndexNestedLoop(&ratings, &basics, join.HashIndex(hashIndex))
+	if err != nil {
+		fmt.Printf("Error joining: %v\n", err)
+		return
+	}
+	report("Index nested-loop (hash)", stats)
+
+	_, stats, err = join.IndexNestedLoop(&ratings, &basics, join.TreeIndex(tree))
+	if err != nil {
+		fmt.Printf("Error joining: %v\n", err)
+		return
+	}
+	report("Index nested-loop (B+ tree)", stats)
+
+	for _, buffers := range []int{3, 10, 100} {
+		_, stats, err = join.SortMerge(&ratings, &basics, buffers)
+		if err != nil {
+			fmt.Printf("Error joining: %v\n", err)
+			return
+		}
+		report(fmt.Sprintf("Sort-merge (%v buffers)", buffers), stats)
+	}
+}
+
+// Experiment: one disk holding the ratings and title.basics tables, with the catalog persisted in catalog pages
+func runCatalogExperiment(blockSize int) {
+	fmt.Println("\n=== Multi-table catalog ===")
+	vd, err := fs.NewVirtualDisk(600, blockSize)
+	if err != nil {
+		fmt.Printf("Error creating virtual disk: %v\n", err)
+		return
+	}
+	if err = vd.CreateCatalog(); err != nil {
+		fmt.Printf("Error creating catalog: %v\n", err)
+		return
+	}
+	if _, err = vd.CreateTable("ratings", fs.RatingsSchema); err != nil {
+		fmt.Printf("Error creating table: %v\n", err)
+		return
+	}
+	if _, err = vd.CreateTable("basics", fs.BasicsSchema); err != nil {
+		fmt.Printf("Error creating table: %v\n", err)
+		return
+	}
+	if err = vd.LoadRecordsInto("ratings", "./data/data.tsv"); err != nil {
+		fmt.Printf("Error loading records: %v\n", err)
+		return
+	}
+	if err = vd.LoadBasicsInto("basics", "./data/basics.tsv"); err != nil {
+		fmt.Printf("Error loading basics: %v\n", err)
+		return
+	}
+
+	// Index numVotes of ratings, the index stays in memory and only its definition is kept in the catalog
+	tree := bptree.New(indexOrder(vd.BlockSize))
+	scanner, err := vd.ScanTable("ratings", nil)
+	if err != nil {
+		fmt.Printf("Error scanning table: %v\n", err)
+		return
+	}
+	for scanner.Next() {
+		tree.Insert(scanner.Record().NumVotes, scanner.Addr())
+	}
+	err = vd.RegisterIndex("ratings", fs.IndexInfo{Name: "ratings_numVotes", Column: "numVotes", Kind: "bptree"})
+	if err != nil {
+		fmt.Printf("Error registering index: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Disk blocks: %v, catalog pages: %v\n", len(vd.Blocks), len(vd.Catalog.Pages))
+	fmt.Printf("%-10v %-10v %-8v %-8v %-8v %v\n", "Table", "Schema", "Record", "Pages", "Extents", "Indexes")
+	for _, table := range vd.Catalog.Tables {
+		fmt.Printf("%-10v %-10v %-8v %-8v %-8v %v\n", table.Name, table.Schema.Name, table.Schema.RecordSize(),
+			len(table.Pages), len(table.Extents()), len(table.Indexes))
+	}
+	if _, err = vd.WriteRecord(&fs.Record{Tconst: "tt0000001", AverageRating: 5, NumVotes: 1}); err != nil {
+		fmt.Printf("Writing outside of a table: %v\n", err)
+	}
+
+	// Reopen the disk from its blocks only
+	reopened := fs.VirtualDisk{Capacity: vd.Capacity, BlockSize: vd.BlockSize, Blocks: vd.Blocks}
+	if err = reopened.LoadCatalog(); err != nil {
+		fmt.Printf("Error loading catalog: %v\n", err)
+		return
+	}
+	for _, table := range reopened.Catalog.Tables {
+		blocks, _ := reopened.TableBlocks(table.Name)
+		count := 0
+		for _, block := range blocks {
+			if table.Schema.Name == fs.BasicsSchema.Name {
+				basics, _ := fs.BlockToBasics(block)
+				count += len(basics)
+			} else {
+				records, _ := fs.BlockToRecords(block)
+				count += len(records)
+			}
+		}
+		fmt.Printf("Reopened table %v: %v records in %v pages, indexes: %v\n", table.Name, count, len(blocks), table.Indexes)
+	}
+	fmt.Printf("Look-up table after reopening: %v of %v records\n", len(reopened.LuTable), len(vd.LuTable))
+}
+
+// Experiment: reuse of released blocks, auto-grow and compaction
+func runAllocExperiment(blockSize int) {
+	fmt.Println("\n=== Block allocation ===")
+	vd, err := fs.NewVirtualDisk(1, blockSize)
+	if err != nil {
+		fmt.Printf("Error creating virtual disk: %v\n", err)
+		return
+	}
+	// Start with room for 500 blocks, and grow 100 blocks at a time
+	vd.Capacity = 500 * blockSize
+	vd.Growth = 100 * blockSize
+	err = vd.LoadRecords("./data/data.tsv")
+	if err != nil {
+		fmt.Printf("Error loading records: %v\n", err)
+		return
+	}
+	err = vd.Cluster()
+	if err != nil {
+		fmt.Printf("Error clustering records: %v\n", err)
+		return
+	}
+	table, err := query.NewTable("ratings", &vd, indexOrder(vd.BlockSize))
+	if err != nil {
+		fmt.Printf("Error building index: %v\n", err)
+		return
+	}
+
+	report := func(step string) {
+		maxBlocks, usedBlocks, _, _ := vd.GetDiskStats()
+		result, err := table.Run("SELECT COUNT(*) FROM ratings")
+		if err != nil {
+			fmt.Printf("Error counting records: %v\n", err)
+			return
+		}
+		fmt.Printf("%-28v %-8v %-8v %-8v %-8v %v\n", step, maxBlocks, len(vd.Blocks), usedBlocks, vd.FreeBlocks(), result.Value)
+	}
+	fmt.Printf("%-28v %-8v %-8v %-8v %-8v %v\n", "Step", "Max", "Blocks", "Used", "Free", "Records")
+	report("Loaded, grown from 500")
+
+	// Delete the records with few votes, clustering packs them into whole blocks that get released
+	var deleted []fs.Record
+	scanner := vd.Scan(func(record fs.Record) bool {
+		return record.NumVotes <= 10
+	})
+	for scanner.Next() {
+		deleted = append(deleted, scanner.Record())
+	}
+	if _, err = table.Run("DELETE FROM ratings WHERE numVotes <= 10"); err != nil {
+		fmt.Printf("Error deleting records: %v\n", err)
+		return
+	}
+	report(fmt.Sprintf("Deleted %v records", len(deleted)))
+
+	for i := range deleted {
+		if _, err = table.Insert(&deleted[i]); err != nil {
+			fmt.Printf("Error inserting record: %v\n", err)
+			return
+		}
+	}
+	report("Reinserted them")
+
+	// Scattered deletes leave blocks partly used until compaction
+	if _, err = table.Run("DELETE FROM ratings WHERE averageRating >= 7"); err != nil {
+		fmt.Printf("Error deleting records: %v\n", err)
+		return
+	}
+	report("Deleted averageRating >= 7")
+	if err = table.Compact(); err != nil {
+		fmt.Printf("Error compacting disk: %v\n", err)
+		return
+	}
+	report("Compacted")
+
+	result, err := table.Run("SELECT COUNT(*) FROM ratings WHERE numVotes BETWEEN 100 AND 1000")
+	if err != nil {
+		fmt.Printf("Error counting records: %v\n", err)
+		return
+	}
+	count := 0
+	scanner = vd.Scan(func(record fs.Record) bool {
+		return record.NumVotes >= 100 && record.NumVotes <= 1000
+	})
+	for scanner.Next() {
+		count++
+	}
+	fmt.Printf("numVotes BETWEEN 100 AND 1000 after compaction: %v by index, %v by scan\n", result.Value, count)
+}
+
+// Experiment: fanout of the tconst index on title.basics with and without key compression
+func runCompressionExperiment(blockSize int) {
+	fmt.Println("\n=== Key compression ===")
+	ratings, err := loadDisk(100, blockSize)
+	if err != nil {
+		fmt.Printf("Error loading records: %v\n", err)
+		return
+	}
+	basics, err := fs.NewVirtualDisk(500, blockSize)
+	if err != nil {
+		fmt.Printf("Error creating virtual disk: %v\n", err)
+		return
+	}
+	err = basics.LoadBasics("./data/basics.tsv")
+	if err != nil {
+		fmt.Printf("Error loading basics: %v\n", err)
+		return
+	}
+
+	plain, err := join.BuildTreeIndex(&basics, indexOrder(blockSize))
+	if err != nil {
+		fmt.Printf("Error building index: %v\n", err)
+		return
+	}
+	compressed, err := join.BuildTreeIndex(&basics, indexOrder(blockSize), bptree.WithKeyCompression(blockSize))
+	if err != nil {
+		fmt.Printf("Error building index: %v\n", err)
+		return
+	}
+
+	fmt.Printf("%-12v %-8v %-8v %-8v %-18v %-14v %-10v %v\n", "Index", "Order", "Height", "Nodes", "Internal fanout", "Leaf fanout", "Join I/O", "Matches")
+	for _, index := range []struct {
+		name string
+		tree *bptree.BPTree
+	}{{"Plain", plain}, {"Compressed", compressed}} {
+		_, stats, err := join.IndexNestedLoop(&ratings, &basics, join.TreeIndex(index.tree))
+		if err != nil {
+			fmt.Printf("Error joining: %v\n", err)
+			return
+		}
+		internal, leaf := index.tree.Fanout()
+		fmt.Printf("%-12v %-8v %-8v %-8v %-18.2f %-14.2f %-10v %v\n", index.name, index.tree.Order, index.tree.GetHeight(),
+			index.tree.GetTotalNodes(), internal, leaf, stats.Total(), stats.Matches)
+	}
+}
+
+// Experiment: read-ahead of leaves and data blocks during range scans, through a buffer pool
+func runPrefetchExperiment(blockSize int) {
+	fmt.Println("\n=== Leaf prefetching ===")
+	vd, err := loadDisk(100, blockSize)
+	if err != nil {
+		fmt.Printf("Error loading records: %v\n", err)
+		return
+	}
+	err = vd.Cluster()
+	if err != nil {
+		fmt.Printf("Error clustering records: %v\n", err)
+		return
+	}
+	tree := bptree.New(indexOrder(vd.BlockSize))
+	scanner := vd.Scan(nil)
+	for scanner.Next() {
+		tree.Insert(scanner.Record().NumVotes, scanner.Addr())
+	}
+
+	from, to := uint32(100), uint32(100000)
+	expected := len(tree.SearchRange(from, to, false))
+	fmt.Printf("Range scan of numVotes BETWEEN %v AND %v: %v records\n", from, to, expected)
+	fmt.Printf("%-8v %-8v %-8v %-8v %-10v %-12v %-17v %v\n", "Pool", "Depth", "Reads", "Misses", "Hit rate", "Prefetches", "Prefetch hit rate", "Records")
+	for _, capacity := range []int{8, 64} {
+		for _, depth := range []int{0, 1, 4, 16} {
+			pool := buffer.New(capacity)
+			records := tree.SearchRangePrefetch(from, to, buffer.RangeReader{Pool: pool, Disk: &vd}, depth)
+			stats := pool.Stats
+			fmt.Printf("%-8v %-8v %-8v %-8v %-10.2f %-12v %-17.2f %v\n", capacity, depth, stats.Reads, stats.Misses,
+				stats.HitRate(), stats.Prefetches, stats.PrefetchHitRate(), len(records))
+		}
+	}
+}
+
+func runSnapshotExperiment(blockSize int) {
+	fmt.Println("\n=== Copy-on-write snapshots ===")
+	vd, err := loadDisk(100, blockSize)
+	if err != nil {
+		fmt.Printf("Error loading records: %v\n", err)
+		return
+	}
+	tree := bptree.New(indexOrder(vd.BlockSize), bptree.WithCopyOnWrite())
+	scanner := vd.Scan(nil)
+	for scanner.Next() {
+		tree.Insert(scanner.Record().NumVotes, scanner.Addr())
+	}
+
+	// The snapshot keeps seeing the index as of now while it's rewritten
+	from, to := uint32(500), uint32(1000)
+	snapshot := tree.Snapshot()
+	before := snapshot.CountRange(from, to)
+	deleted, err := tree.DeleteRange(from, to)
+	if err != nil {
+		fmt.Printf("Error deleting range: %v\n", err)
+		return
+	}
+	for i, addr := range deleted {
+		tree.Insert(to+1+uint32(i%100), addr)
+	}
+
+	fmt.Printf("Moved %v records out of numVotes BETWEEN %v AND %v\n", len(deleted), from, to)
+	fmt.Printf("%-10v %-10v %-10v\n", "Version", "In range", "Nodes")
+	fmt.Printf("%-10v %-10v %-10v\n", "Snapshot", snapshot.CountRange(from, to), snapshot.GetTotalNodes())
+	fmt.Printf("%-10v %-10v %-10v\n", "Current", tree.CountRange(from, to), tree.GetTotalNodes())
+	fmt.Printf("Snapshot unchanged: %v\n", snapshot.CountRange(from, to) == before)
+	if err := snapshot.Delete(from); err != nil {
+		fmt.Printf("Deleting from the snapshot: %v\n", err)
+	}
+}
+
+// Experiment: readers at an older timestamp keep seeing the versions of its time
+func runVersionExperiment(blockSize int) {
+	fmt.Println("\n=== Record versions ===")
+	vd, err := loadDisk(100, blockSize)
+	if err != nil {
+		fmt.Printf("Error loading records: %v\n", err)
+		return
+	}
+	err = vd.Cluster()
+	if err != nil {
+		fmt.Printf("Error clustering records: %v\n", err)
+		return
+	}
+	tree := bptree.New(indexOrder(vd.BlockSize), bptree.WithCopyOnWrite())
+	scanner := vd.Scan(nil)
+	for scanner.Next() {
+		tree.Insert(scanner.Record().NumVotes, scanner.Addr())
+	}
+
+	// A reader takes its timestamp and a snapshot of the index
+	from, to := uint32(1000), uint32(2000)
+	ts := vd.Now()
+	snapshot := tree.Snapshot()
+
+	// Add a vote to every record in range, and expire the records with the fewest votes
+	updated, expired := 0, 0
+	for _, addr := range tree.SearchRange(from, to, false) {
+		record, err := fs.AddrToRecord(&vd, addr)
+		if err != nil {
+			fmt.Printf("Error reading record: %v\n", err)
+			return
+		}
+		record.NumVotes++
+		newAddr, err := vd.UpdateRecord(addr, &record)
+		if err != nil {
+			fmt.Printf("Error updating record: %v\n", err)
+			return
+		}
+		tree.DeleteRecord(record.NumVotes-1, addr)
+		tree.Insert(record.NumVotes, newAddr)
+		updated++
+	}
+	for _, addr := range tree.SearchRange(1, 5, false) {
+		if err = vd.ExpireRecord(addr); err != nil {
+			fmt.Printf("Error expiring record: %v\n", err)
+			return
+		}
+		record, _ := fs.ReadVersion(&vd, addr)
+		tree.DeleteRecord(record.NumVotes, addr)
+		expired++
+	}
+	fmt.Printf("Updated %v records in numVotes BETWEEN %v AND %v, expired %v records with numVotes <= 5\n",
+		updated, from, to, expired)
+
+	// Records of the range read through the index, and average numVotes of a scan, at both timestamps
+	read := func(tree *bptree.BPTree, ts uint64) (int, float64) {
+		count := 0
+		for _, addr := range tree.SearchRange(from, to, false) {
+			if _, err := fs.AddrToRecordAt(&vd, addr, ts); err == nil {
+				count++
+			}
+		}
+		var records, votes int
+		scanner := vd.ScanAt(ts, nil)
+		for scanner.Next() {
+			records++
+			votes += int(scanner.Record().NumVotes)
+		}
+		return count, float64(votes) / float64(records)
+	}
+	fmt.Printf("%-10v %-12v %-10v %v\n", "Reader", "Timestamp", "In range", "Avg numVotes")
+	count, avg := read(snapshot, ts)
+	fmt.Printf("%-10v %-12v %-10v %.4f\n", "Old", ts, count, avg)
+	count, avg = read(tree, vd.Now())
+	fmt.Printf("%-10v %-12v %-10v %.4f\n", "Current", vd.Now(), count, avg)
+
+	// Once the old reader is done, its versions can go
+	for _, horizon := range []uint64{ts, vd.Now()} {
+		dead, err := vd.Vacuum(horizon)
+		if err != nil {
+			fmt.Printf("Error vacuuming: %v\n", err)
+			return
+		}
+		_, usedBlocks, _, _ := vd.GetDiskStats()
+		fmt.Printf("Vacuum up to %v: %v versions deleted, %v blocks used, %v free\n", horizon, len(dead), usedBlocks, vd.FreeBlocks())
+	}
+}
+
+// Experiment: batches of ratings and their index entries written atomically
+func runTransactionExperiment(blockSize int) {
+	fmt.Println("\n=== Transactions ===")
+	vd, err := loadDisk(100, blockSize)
+	if err != nil {
+		fmt.Printf("Error loading records: %v\n", err)
+		return
+	}
+	tree := bptree.New(indexOrder(vd.BlockSize))
+	scanner := vd.Scan(nil)
+	for scanner.Next() {
+		tree.Insert(scanner.Record().NumVotes, scanner.Addr())
+	}
+	manager := txn.New(&vd)
+
+	// Write a batch of 100 ratings and index them, all or nothing
+	insertBatch := func(tx *txn.Txn, batch int) error {
+		for i := 0; i < 100; i++ {
+			record := fs.Record{Tconst: fmt.Sprintf("tx%02d%05d", batch, i), AverageRating: 5, NumVotes: uint32(1_000_000 + i)}
+			addr, err := tx.WriteRecord(&record)
+			if err != nil {
+				return err
+			}
+			if err = tx.Insert(tree, record.NumVotes, addr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	report := func(step string) {
+		records := 0
+		scanner := vd.Scan(nil)
+		for scanner.Next() {
+			records++
+		}
+		fmt.Printf("%-36v %-10v %v\n", step, records, tree.CountRange(1, ^uint32(0)))
+	}
+	fmt.Printf("%-36v %-10v %v\n", "Step", "Records", "Index entries")
+	report("Loaded")
+
+	tx := manager.Begin()
+	if err = insertBatch(tx, 1); err != nil {
+		fmt.Printf("Error writing batch: %v\n", err)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		fmt.Printf("Error committing: %v\n", err)
+		return
+	}
+	report("Batch 1 committed")
+
+	tx = manager.Begin()
+	if err = insertBatch(tx, 2); err != nil {
+		fmt.Printf("Error writing batch: %v\n", err)
+		return
+	}
+	report("Batch 2 written")
+	if err = tx.Abort(); err != nil {
+		fmt.Printf("Error aborting: %v\n", err)
+		return
+	}
+	report("Batch 2 aborted")
+
+	// A reader of a key written by a running transaction waits for it, here until it times out,
+	// and retries once the writer is done
+	manager.Locks.Timeout = 100 * time.Millisecond
+	writer := manager.Begin()
+	if err = insertBatch(writer, 3); err != nil {
+		fmt.Printf("Error writing batch: %v\n", err)
+		return
+	}
+	reader := manager.Begin()
+	if _, err = reader.Search(tree, 1_000_000); err != nil {
+		fmt.Printf("Reader while batch 3 is running: %v\n", err)
+		reader.Abort()
+	}
+	writer.Commit()
+	reader = manager.Begin()
+	addrs, err := reader.Search(tree, 1_000_000)
+	if err != nil {
+		fmt.Printf("Error searching: %v\n", err)
+		return
+	}
+	reader.Commit()
+	fmt.Printf("Reader after batch 3 committed: %v records with numVotes = 1000000\n", len(addrs))
+	report("Batch 3 committed")
+	fmt.Printf("Committed: %v, aborted: %v, lock timeouts: %v\n", manager.Stats.Committed, manager.Stats.Aborted, manager.Locks.Stats.Timeouts)
+}
+
+// Experiment: concurrent transactions waiting on each other's locks
+func runLockExperiment(blockSize int) {
+	fmt.Println("\n=== Lock manager ===")
+	vd, err := loadDisk(100, blockSize)
+	if err != nil {
+		fmt.Printf("Error loading records: %v\n", err)
+		return
+	}
+	tree := bptree.New(indexOrder(vd.BlockSize))
+	scanner := vd.Scan(nil)
+	for scanner.Next() {
+		tree.Insert(scanner.Record().NumVotes, scanner.Addr())
+	}
+	manager := txn.New(&vd)
+	manager.Locks.Timeout = time.Second
+
+	// Phantoms: a range scanned twice by a transaction gets the same records, a writer in range waits for it
+	from, to := uint32(100), uint32(150)
+	scan := manager.Begin()
+	first, err := scan.SearchRange(tree, from, to)
+	if err != nil {
+		fmt.Printf("Error scanning: %v\n", err)
+		return
+	}
+	inserted := make(chan error)
+	go func() {
+		tx := manager.Begin()
+		record := fs.Record{Tconst: "tt9999998", AverageRating: 5, NumVotes: 125}
+		addr, err := tx.WriteRecord(&record)
+		if err == nil {
+			err = tx.Insert(tree, record.NumVotes, addr)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		inserted <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	second, err := scan.SearchRange(tree, from, to)
+	if err != nil {
+		fmt.Printf("Error scanning: %v\n", err)
+		return
+	}
+	scan.Commit()
+	if err = <-inserted; err != nil {
+		fmt.Printf("Error inserting: %v\n", err)
+		return
+	}
+	fmt.Printf("numVotes BETWEEN %v AND %v, scanned twice while a key is inserted in range: %v, then %v records\n",
+		from, to, len(first), len(second))
+	fmt.Printf("After the scan commits and the insert goes through: %v records\n", tree.CountRange(from, to))
+
+	// Deadlock: two transactions each delete the key the other one holds
+	keyA, _ := tree.NextKey(1000)
+	keyB, _ := tree.NextKey(2000)
+	a, b := manager.Begin(), manager.Begin()
+	if err = a.Delete(tree, keyA); err != nil {
+		fmt.Printf("Error deleting: %v\n", err)
+		return
+	}
+	if err = b.Delete(tree, keyB); err != nil {
+		fmt.Printf("Error deleting: %v\n", err)
+		return
+	}
+	deleted := make(chan error)
+	go func() {
+		deleted <- a.Delete(tree, keyB)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err = b.Delete(tree, keyA); err != nil {
+		fmt.Printf("Transaction %v: %v\n", b.ID, err)
+		b.Abort()
+	}
+	if err = <-deleted; err != nil {
+		fmt.Printf("Error deleting: %v\n", err)
+		return
+	}
+	a.Commit()
+	fmt.Printf("Transaction %v went on once %v aborted, records with numVotes %v or %v left: %v\n", a.ID, b.ID, keyA, keyB,
+		tree.CountRange(keyA, keyA)+tree.CountRange(keyB, keyB))
+
+	// Block locks: a writer waits for a reader of the whole block it writes to, until it times out
+	manager.Locks.Timeout = 100 * time.Millisecond
+	block, _ := vd.NextRecordSlot()
+	reader := manager.Begin()
+	if _, _, err = reader.ReadBlock(block); err != nil {
+		fmt.Printf("Error reading block: %v\n", err)
+		return
+	}
+	writer := manager.Begin()
+	if _, err = writer.WriteRecord(&fs.Record{Tconst: "tt9999999", AverageRating: 5, NumVotes: 1}); err != nil {
+		fmt.Printf("Writer while block %v is read: %v\n", block, err)
+		writer.Abort()
+	}
+	reader.Commit()
+
+	stats := manager.Locks.Stats
+	fmt.Printf("Locks granted: %v, waits: %v, deadlocks: %v, timeouts: %v\n", stats.Granted, stats.Waits, stats.Deadlocks, stats.Timeouts)
 }
@@ -3,15 +3,22 @@ module github.com/weixingp/CZ4031-Project1
 go 1.19
 
 require github.com/sirupsen/logrus v1.7.0
+
 require internal/fs v1.0.0
 
 require (
+	github.com/grailbio/base v0.0.10
 	github.com/schollz/progressbar/v3 v3.11.0
+	internal/bitmap v1.0.0
 	internal/bptree v1.0.0
+	internal/buffer v1.0.0
+	internal/hashidx v1.0.0
+	internal/join v1.0.0
+	internal/query v1.0.0
+	internal/txn v1.0.0
 )
 
 require (
-	github.com/grailbio/base v0.0.10 // indirect
 	github.com/mattn/go-runewidth v0.0.14 // indirect
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.2 // indirect
@@ -22,3 +29,15 @@ require (
 replace internal/fs => ./internal/fs
 
 replace internal/bptree => ./internal/bptree
+
+replace internal/query => ./internal/query
+
+replace internal/hashidx => ./internal/hashidx
+
+replace internal/bitmap => ./internal/bitmap
+
+replace internal/join => ./internal/join
+
+replace internal/buffer => ./internal/buffer
+
+replace internal/txn => ./internal/txn
@@ -0,0 +1,96 @@
+// Package bitmap contains a bitmap index on AverageRating, with plain and WAH compressed bitmaps over record IDs
+package bitmap
+
+import (
+	"math/bits"
+)
+
+// Bitmap Uncompressed set of record IDs, bit i is set if record i is in the set
+type Bitmap struct {
+	words []uint64
+}
+
+// New Create an empty bitmap
+func New() *Bitmap {
+	return &Bitmap{}
+}
+
+// Set Add record i to the set
+func (b *Bitmap) Set(i int) {
+	for i/64 >= len(b.words) {
+		b.words = append(b.words, 0)
+	}
+	b.words[i/64] |= 1 << (i % 64)
+}
+
+// Clear Remove record i from the set
+func (b *Bitmap) Clear(i int) {
+	if i/64 < len(b.words) {
+		b.words[i/64] &^= 1 << (i % 64)
+	}
+}
+
+// Get Check if record i is in the set
+func (b *Bitmap) Get(i int) bool {
+	return i/64 < len(b.words) && b.words[i/64]&(1<<(i%64)) != 0
+}
+
+// And Intersection of two bitmaps
+func (b *Bitmap) And(other *Bitmap) *Bitmap {
+	n := len(b.words)
+	if len(other.words) < n {
+		n = len(other.words)
+	}
+
+	result := &Bitmap{words: make([]uint64, n)}
+	for i := 0; i < n; i++ {
+		result.words[i] = b.words[i] & other.words[i]
+	}
+	return result
+}
+
+// Or Union of two bitmaps
+func (b *Bitmap) Or(other *Bitmap) *Bitmap {
+	longer, shorter := b, other
+	if len(other.words) > len(b.words) {
+		longer, shorter = other, b
+	}
+
+	result := &Bitmap{words: make([]uint64, len(longer.words))}
+	copy(result.words, longer.words)
+	for i, word := range shorter.words {
+		result.words[i] |= word
+	}
+	return result
+}
+
+// Count Get the number of records in the set
+func (b *Bitmap) Count() int {
+	count := 0
+	for _, word := range b.words {
+		count += bits.OnesCount64(word)
+	}
+	return count
+}
+
+// Positions Get the record IDs in the set, in ascending order
+func (b *Bitmap) Positions() []int {
+	var positions []int
+	for i, word := range b.words {
+		for word != 0 {
+			positions = append(positions, i*64+bits.TrailingZeros64(word))
+			word &= word - 1
+		}
+	}
+	return positions
+}
+
+// Len Get the number of bits held, a multiple of 64
+func (b *Bitmap) Len() int {
+	return len(b.words) * 64
+}
+
+// SizeBytes Get the storage size of the bitmap
+func (b *Bitmap) SizeBytes() int {
+	return len(b.words) * 8
+}
@@ -0,0 +1,9 @@
+module bitmap
+
+go 1.19
+
+require internal/fs v1.0.0
+
+require github.com/grailbio/base v0.0.10 // indirect
+
+replace internal/fs => ../fs
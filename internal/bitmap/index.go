@@ -0,0 +1,132 @@
+package bitmap
+
+import (
+	"internal/fs"
+	"sort"
+)
+
+// Index Bitmap per distinct AverageRating over the records of a VirtualDisk
+// Record ID of a record = block index * records per block + slot in the block
+type Index struct {
+	Bitmaps map[uint16]*Bitmap // Key: rating * 10, as stored by RecordToBytes
+
+	disk     *fs.VirtualDisk
+	perBlock int // Records per block
+}
+
+// Build Index every record on disk
+// Return fs.ErrTableRequired if the disk has a catalog, see VirtualDisk.Scan
+func Build(disk *fs.VirtualDisk) (*Index, error) {
+	index := &Index{
+		Bitmaps:  map[uint16]*Bitmap{},
+		disk:     disk,
+		perBlock: disk.BlockSize / (fs.RecordSize + 2), // Same block capacity as WriteRecord
+	}
+
+	scanner := disk.Scan(nil)
+	for scanner.Next() {
+		index.set(scanner.Record(), scanner.Addr())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// Insert Add the record at addr, after it's written to disk
+// Like the B+ tree indexes, the bitmaps hold the old versions of updated records too.
+func (index *Index) Insert(addr *byte) error {
+	record, err := fs.ReadVersion(index.disk, addr)
+	if err != nil {
+		return err
+	}
+	index.set(record, addr)
+	return nil
+}
+
+// Delete Remove the record at addr, before it's deleted from disk, e.g. by Vacuum
+func (index *Index) Delete(addr *byte) error {
+	record, err := fs.ReadVersion(index.disk, addr)
+	if err != nil {
+		return err
+	}
+	if b := index.Bitmaps[ratingKey(record.AverageRating)]; b != nil {
+		b.Clear(index.RecordID(addr))
+	}
+	return nil
+}
+
+// Range Get the records with from <= AverageRating <= to, as the union of the bitmaps of the ratings in range
+func (index *Index) Range(from float64, to float64) *Bitmap {
+	result := New()
+	for key, b := range index.Bitmaps {
+		rating := float64(key) / 10
+		if rating >= from-1e-9 && rating <= to+1e-9 {
+			result = result.Or(b)
+		}
+	}
+	return result
+}
+
+// FromAddrs Convert record addresses, e.g. the result of BPTree.SearchRange, into a bitmap to combine with AND/OR
+func (index *Index) FromAddrs(addrs []*byte) *Bitmap {
+	result := New()
+	for _, addr := range addrs {
+		result.Set(index.RecordID(addr))
+	}
+	return result
+}
+
+// Addrs Get the record addresses of the set bits, in disk order
+func (index *Index) Addrs(b *Bitmap) []*byte {
+	var addrs []*byte
+	for _, id := range b.Positions() {
+		block, slot := id/index.perBlock, id%index.perBlock
+		if block < len(index.disk.Blocks) {
+			addrs = append(addrs, &index.disk.Blocks[block].Content[slot*fs.RecordSize])
+		}
+	}
+	return addrs
+}
+
+// RecordID Get the bit position of the record at addr
+func (index *Index) RecordID(addr *byte) int {
+	loc := index.disk.LuTable[addr]
+	return loc.BlockIndex*index.perBlock + loc.Index
+}
+
+// Ratings Get the indexed ratings * 10, in ascending order
+func (index *Index) Ratings() []uint16 {
+	var keys []uint16
+	for key := range index.Bitmaps {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// SizeBytes Get the total size of the bitmaps, uncompressed and WAH compressed
+func (index *Index) SizeBytes() (plain int, compressed int) {
+	for _, b := range index.Bitmaps {
+		plain += b.SizeBytes()
+		compressed += b.Compress().SizeBytes()
+	}
+	return plain, compressed
+}
+
+func (index *Index) set(record fs.Record, addr *byte) {
+	key := ratingKey(record.AverageRating)
+	b := index.Bitmaps[key]
+	if b == nil {
+		b = New()
+		index.Bitmaps[key] = b
+	}
+	b.Set(index.RecordID(addr))
+}
+
+// Rating as stored on disk, rounded so that float32 noise doesn't move it to the next bitmap
+func ratingKey(rating float32) uint16 {
+	return uint16(rating*10 + 0.5)
+}
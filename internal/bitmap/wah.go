@@ -0,0 +1,195 @@
+package bitmap
+
+import (
+	"math/bits"
+)
+
+// Word-Aligned Hybrid (WAH) encoding on 32 bit words
+// The bitmap is cut into groups of 31 bits:
+// Literal word: 0 + 31 bits of one group
+// Fill word: 1 + fill bit + 30 bits number of consecutive groups that are all 0 or all 1
+const (
+	groupBits  = 31
+	literalMax = 1<<groupBits - 1
+	fillFlag   = 1 << 31
+	fillOnes   = 1 << 30
+	maxRun     = 1<<30 - 1
+)
+
+// WAH Compressed bitmap, long runs of 0s or 1s are stored as a single fill word
+type WAH struct {
+	words  []uint32
+	groups int // Number of 31 bit groups encoded
+}
+
+// Compress Encode the bitmap with WAH
+func (b *Bitmap) Compress() *WAH {
+	w := &WAH{}
+	groups := (b.Len() + groupBits - 1) / groupBits
+	for g := 0; g < groups; g++ {
+		w.appendGroup(b.group(g), 1)
+	}
+	return w
+}
+
+// Decompress Decode into a plain bitmap
+func (w *WAH) Decompress() *Bitmap {
+	b := &Bitmap{words: make([]uint64, (w.groups*groupBits+63)/64)}
+	g := 0
+	r := w.reader()
+	for r.next() {
+		for i := 0; i < r.run; i++ {
+			b.setGroup(g, r.value)
+			g++
+		}
+	}
+	return b
+}
+
+// And Intersection of two compressed bitmaps, without decompressing them
+func (w *WAH) And(other *WAH) *WAH {
+	return w.merge(other, func(x, y uint32) uint32 { return x & y })
+}
+
+// Or Union of two compressed bitmaps, without decompressing them
+func (w *WAH) Or(other *WAH) *WAH {
+	return w.merge(other, func(x, y uint32) uint32 { return x | y })
+}
+
+// Count Get the number of records in the set
+func (w *WAH) Count() int {
+	count := 0
+	r := w.reader()
+	for r.next() {
+		count += bits.OnesCount32(r.value) * r.run
+	}
+	return count
+}
+
+// SizeBytes Get the storage size of the compressed bitmap
+func (w *WAH) SizeBytes() int {
+	return len(w.words) * 4
+}
+
+// Combine two bitmaps run by run, a run of fills is handled in one step
+func (w *WAH) merge(other *WAH, op func(x, y uint32) uint32) *WAH {
+	result := &WAH{}
+	a, b := w.reader(), other.reader()
+	aOk, bOk := a.next(), b.next()
+
+	for aOk || bOk {
+		// The shorter bitmap is padded with 0s
+		if !aOk {
+			a = &wahReader{value: 0, run: b.run, fill: true}
+		}
+		if !bOk {
+			b = &wahReader{value: 0, run: a.run, fill: true}
+		}
+
+		n := 1
+		if a.fill && b.fill {
+			n = a.run
+			if b.run < n {
+				n = b.run
+			}
+		}
+		result.appendGroup(op(a.value, b.value), n)
+
+		a.run -= n
+		b.run -= n
+		if a.run == 0 {
+			aOk = a.next()
+		}
+		if b.run == 0 {
+			bOk = b.next()
+		}
+	}
+	return result
+}
+
+// Append n groups with the same 31 bit value, merging into the previous fill word when possible
+func (w *WAH) appendGroup(value uint32, n int) {
+	w.groups += n
+	if value != 0 && value != literalMax {
+		for ; n > 0; n-- {
+			w.words = append(w.words, value)
+		}
+		return
+	}
+
+	fill := uint32(fillFlag)
+	if value == literalMax {
+		fill |= fillOnes
+	}
+	if last := len(w.words) - 1; last >= 0 && w.words[last]&(fillFlag|fillOnes) == fill {
+		run := int(w.words[last] & maxRun)
+		add := n
+		if run+add > maxRun {
+			add = maxRun - run
+		}
+		w.words[last] += uint32(add)
+		n -= add
+	}
+	for n > 0 {
+		run := n
+		if run > maxRun {
+			run = maxRun
+		}
+		w.words = append(w.words, fill|uint32(run))
+		n -= run
+	}
+}
+
+// Iterator over the runs of a compressed bitmap, a literal is a run of 1 group
+type wahReader struct {
+	words []uint32
+	pos   int
+	value uint32 // 31 bit value of every group in the run
+	run   int    // Groups left in the run
+	fill  bool
+}
+
+func (w *WAH) reader() *wahReader {
+	return &wahReader{words: w.words}
+}
+
+func (r *wahReader) next() bool {
+	if r.pos >= len(r.words) {
+		return false
+	}
+	word := r.words[r.pos]
+	r.pos++
+
+	r.fill = word&fillFlag != 0
+	if !r.fill {
+		r.value, r.run = word, 1
+		return true
+	}
+	r.value = 0
+	if word&fillOnes != 0 {
+		r.value = literalMax
+	}
+	r.run = int(word & maxRun)
+	return true
+}
+
+// Get the 31 bits of group g
+func (b *Bitmap) group(g int) uint32 {
+	var value uint32
+	for i := 0; i < groupBits; i++ {
+		if b.Get(g*groupBits + i) {
+			value |= 1 << i
+		}
+	}
+	return value
+}
+
+// Set the 31 bits of group g
+func (b *Bitmap) setGroup(g int, value uint32) {
+	for i := 0; value != 0; i++ {
+		if value&1 != 0 {
+			b.Set(g*groupBits + i)
+		}
+		value >>= 1
+	}
+}
@@ -1,76 +1,130 @@
 package bptree
 
 import (
+	"errors"
 	"fmt"
 )
 
 // Node design
 // Ptr-Key-Ptr-Key-Ptr
 
+var (
+	ErrKeyNotFound = errors.New("key does not exist")
+	errNodeFull    = errors.New("no space left in node")
+	errNoRecordIDs = errors.New("DuplicateUniquify needs record IDs, see WithRecordIDs")
+)
+
 type BPTree struct {
-	Root  *Node
-	Order int
+	Root       *Node
+	Order      int
+	Duplicates DuplicateStrategy // How records with the same key are stored
 	//Height int
+	NodesAccessed int                     // Index nodes accessed by the last Search/SearchRange/DeleteRange
+	recordID      func(addr *byte) uint32 // Record ID appended to a key, for DuplicateUniquify only
+	blockSize     int                     // Size of a compressed node page, 0 without key compression
+	baseOrder     int                     // Order of the tree without key compression, for rebalancing a compressed tree
+	repack        bool                    // A copy-on-write delete left a node larger than its compressed page
+	cow           bool                    // Writes path-copy nodes, see WithCopyOnWrite
+	readOnly      bool                    // Snapshot, writes fail with ErrReadOnly
 }
 
 type Node struct {
-	//Node size given 64bit system (ignoring header):
-	// 4 bytes * (num of Key) + 8 bytes * (num of Ptr)
-	// Header such as IsLeaf, Parent are ignored.
-	IsLeaf   bool
-	Key      []uint32  //uint32 - 4 bytes
-	Children []*Node   //Children[i] points to node with key < Key[i], Ptr[i+1] for key >= Key[i]
-	DataPtr  []*Record //DataPtr[i] points to the data node with key = Key[i]
-	Next     *Node     //For leaf node only, the next leaf node if any
-	Parent   *Node     //The parent node
+	// Node size given 64bit system, see EncodedSize for the page format:
+	// header + 4 bytes * (num of Key) + 8 bytes * (num of Ptr)
+	IsLeaf     bool
+	Key        []uint64  //uint32 - 4 bytes, widened to hold the appended record ID for DuplicateUniquify
+	Children   []*Node   //Children[i] points to node with key < Key[i], Ptr[i+1] for key >= Key[i]
+	DataPtr    []*Record //DataPtr[i] points to the data node with key = Key[i]
+	Next       *Node     //For leaf node only, the next leaf node if any
+	Parent     *Node     //The parent node
+	wide       bool      //Keys are WideKeySize bytes in the page format, for DuplicateUniquify
+	compressed bool      //Keys are prefix compressed in the page format, see WithKeyCompression
 }
 
 type Record struct {
-	Addr *byte
-	Next *Record
+	Addr  *byte
+	Next  *Record
+	Page  []*byte // Record IDs in this overflow page, for DuplicateOverflow only
+	Tail  *Record // Last record/page of the chain, kept on the first record only
+	Count int     // Number of records in the chain, kept on the first record only
 }
 
-func New(order int) *BPTree {
-	return &BPTree{
+func New(order int, opts ...Option) *BPTree {
+	tree := &BPTree{
 		Root:  nil,
 		Order: order,
 	}
+	for _, opt := range opts {
+		opt(tree)
+	}
+	if tree.blockSize > 0 {
+		tree.initCompression()
+	}
+	return tree
 }
 
-func (tree *BPTree) Insert(key uint32, addr *byte) {
+// Insert Add a key pointing to the record at addr
+// Return a DuplicateKeyError (ErrDuplicateKey) if the key exists and the tree is a unique index
+func (tree *BPTree) Insert(key uint32, addr *byte) error {
 	var node *Node
+	if tree.readOnly {
+		return ErrReadOnly
+	}
+
+	k, err := tree.recordKey(key, addr)
+	if err != nil {
+		return err
+	}
+	if tree.cow {
+		return tree.insertCOW(key, k, addr)
+	}
 
 	if tree.Root == nil {
 		node = tree.newLeafNode()
 		tree.Root = node
 	} else {
-		node, _ = tree.locateLeaf(key, false)
+		node, _ = tree.locateLeaf(k, false)
 	}
 
-	// Add the duplicate key linked list if key exists
+	// Handle the duplicate key if key exists
 	for i, item := range node.Key {
-		if item == key {
-			node.DataPtr[i].insert(addr)
-			return
+		if item == k {
+			switch tree.Duplicates {
+			case DuplicateReject:
+				return &DuplicateKeyError{Key: key, Addr: node.DataPtr[i].Addr}
+			case DuplicateOverflow:
+				node.DataPtr[i].insertIntoPage(addr, tree.Order)
+			default:
+				node.DataPtr[i].insert(addr)
+			}
+			return nil
 		}
 	}
 
-	if node.getKeySize() < tree.Order-1 {
-		node.insertIntoLeaf(key, addr)
-	} else {
-		tree.splitAndInsertIntoLeaf(node, key, addr)
+	if tree.hasRoom(node, k) {
+		return node.insertIntoLeaf(k, addr)
 	}
-
+	return tree.splitAndInsertIntoLeaf(node, k, addr)
 }
 
 func (tree *BPTree) Search(key uint32, verbose bool) []*byte {
-	node, count := tree.locateLeaf(key, verbose)
+	if tree.Duplicates == DuplicateUniquify {
+		// Duplicates are spread over different keys, possibly over several leaves
+		return tree.searchRange(tree.lowKey(key), tree.highKey(key), verbose)
+	}
+
+	node, count := tree.locateLeaf(uint64(key), verbose)
+	tree.NodesAccessed = count
+	if node == nil {
+		// Empty tree
+		return nil
+	}
 
 	if verbose {
 		fmt.Printf("Total index node accessed: %v\n", count)
 	}
 	for i, item := range node.Key {
-		if item == key {
+		if item == uint64(key) {
 			return node.DataPtr[i].extractDuplicateKeyRecords()
 		}
 	}
@@ -78,19 +132,28 @@ func (tree *BPTree) Search(key uint32, verbose bool) []*byte {
 }
 
 func (tree *BPTree) SearchRange(fromKey uint32, toKey uint32, verbose bool) []*byte {
+	return tree.searchRange(tree.lowKey(fromKey), tree.highKey(toKey), verbose)
+}
+
+func (tree *BPTree) searchRange(fromKey uint64, toKey uint64, verbose bool) []*byte {
 	var records []*byte
 	node, count := tree.locateLeaf(fromKey, verbose)
+	tree.NodesAccessed = count
+	if node == nil {
+		// Empty tree
+		return nil
+	}
 
 	// Process first node
 	for i, item := range node.Key {
-		if item == 0 {
+		if item == 0 || item > toKey {
 			break
 		}
 		if item >= fromKey {
 			records = append(records, node.DataPtr[i].extractDuplicateKeyRecords()...)
 		}
 	}
-	node = node.Next
+	node = tree.nextLeaf(node)
 
 	for node != nil {
 		count += 1
@@ -112,23 +175,149 @@ func (tree *BPTree) SearchRange(fromKey uint32, toKey uint32, verbose bool) []*b
 			// Range reached
 			break
 		}
-		node = node.Next
+		node = tree.nextLeaf(node)
 
 	}
 	if verbose {
 		fmt.Printf("Total index node accessed: %v\n", count)
 	}
+	tree.NodesAccessed = count
 	return records
 
 }
 
-func (tree *BPTree) Delete(key uint32) {
-	node, _ := tree.locateLeaf(key, false)
-	tree.deleteKey(node, key)
+// NextKey Get the smallest key larger than key, false if there is none
+func (tree *BPTree) NextKey(key uint32) (uint32, bool) {
+	k := tree.highKey(key)
+	node, count := tree.locateLeaf(k, false)
+	for node != nil {
+		for i := 0; i < node.getKeySize(); i++ {
+			if node.Key[i] > k {
+				tree.NodesAccessed = count
+				return tree.userKey(node.Key[i]), true
+			}
+		}
+
+		node = tree.nextLeaf(node)
+		if node != nil {
+			count++
+		}
+	}
+	tree.NodesAccessed = count
+	return 0, false
+}
+
+// Delete Remove the key together with its duplicate key records
+// Return ErrKeyNotFound if the key doesn't exist
+func (tree *BPTree) Delete(key uint32) error {
+	if tree.readOnly {
+		return ErrReadOnly
+	}
+	if tree.Root == nil {
+		return ErrKeyNotFound
+	}
+
+	if tree.Duplicates == DuplicateUniquify {
+		deleted, err := tree.DeleteRange(key, key)
+		if err != nil {
+			return err
+		}
+		if len(deleted) == 0 {
+			return ErrKeyNotFound
+		}
+		return nil
+	}
+
+	node, _ := tree.locateLeaf(uint64(key), false)
+	return tree.deleteKey(node, uint64(key))
+}
+
+// DeleteRange Remove all keys in [fromKey, toKey] together with their duplicate key records.
+// Keys are removed by walking the leaf chain, the tree is only rebalanced once at the end.
+// Return the addresses of the removed records, pass them to VirtualDisk.DeleteRecord to remove the rows as well.
+// On error the records of the keys removed before it are returned.
+func (tree *BPTree) DeleteRange(fromKey uint32, toKey uint32) ([]*byte, error) {
+	return tree.deleteRange(tree.lowKey(fromKey), tree.highKey(toKey))
+}
+
+func (tree *BPTree) deleteRange(fromKey uint64, toKey uint64) ([]*byte, error) {
+	var records []*byte
+
+	if tree.readOnly {
+		return nil, ErrReadOnly
+	}
+	if tree.Root == nil || fromKey > toKey {
+		return nil, nil
+	}
+	if tree.cow {
+		return tree.deleteRangeCOW(fromKey, toKey)
+	}
+
+	minKey := tree.minOrder() / 2 // floor( (n+1)/2 )
+	underflow := false
+
+	node, count := tree.locateLeaf(fromKey, false)
+	for node != nil {
+		keySize := node.getKeySize()
+		if keySize == 0 {
+			node = node.Next
+			if node != nil {
+				count++
+			}
+			continue
+		}
+		if node.Key[0] > toKey {
+			// Range reached
+			break
+		}
+		lastKey := node.Key[keySize-1]
+
+		// Keep the keys outside the range, in place
+		kept := 0
+		for i := 0; i < keySize; i++ {
+			if node.Key[i] >= fromKey && node.Key[i] <= toKey {
+				records = append(records, node.DataPtr[i].extractDuplicateKeyRecords()...)
+				continue
+			}
+			node.Key[kept] = node.Key[i]
+			node.DataPtr[kept] = node.DataPtr[i]
+			kept++
+		}
+		for i := kept; i < keySize; i++ {
+			node.Key[i] = 0
+			node.DataPtr[i] = nil
+		}
+
+		if kept < keySize && kept < minKey {
+			underflow = true
+		}
+
+		if lastKey >= toKey {
+			// Range reached
+			break
+		}
+		node = node.Next
+		if node != nil {
+			count++
+		}
+	}
+	tree.NodesAccessed = count
+
+	// Separator keys are still valid bounds after removing keys,
+	// so the tree only needs to be rebuilt when a leaf is left with too few keys.
+	if underflow {
+		tree.rebuild()
+	}
+
+	return records, nil
 }
 
 func (tree *BPTree) Print() {
 	fmt.Println("Tree:")
+	if tree.Root == nil {
+		fmt.Println("Empty")
+		return
+	}
 	node := tree.Root
 	next := tree.Root.Children
 	fmt.Printf("%v\n", node.Key)
@@ -159,7 +348,7 @@ func (tree *BPTree) PrintLeaves() {
 
 	for node != nil {
 		fmt.Printf("%v -> ", node.Key)
-		node = node.Next
+		node = tree.nextLeaf(node)
 	}
 	fmt.Println("End")
 
@@ -214,15 +403,35 @@ func (tree *BPTree) GetTotalNodes() int {
 	return count
 }
 
+func (tree *BPTree) GetTotalLeaves() int {
+	node, _ := tree.locateLeaf(0, false)
+
+	count := 0
+	for node != nil {
+		count++
+		node = tree.nextLeaf(node)
+	}
+	return count
+}
+
+// Create the first record of a key
+func newRecord(addr *byte) *Record {
+	return &Record{
+		Addr:  addr,
+		Count: 1,
+	}
+}
+
 // Extract all records with the same key
 func (record *Record) extractDuplicateKeyRecords() []*byte {
-	r := record
-	res := []*byte{r.Addr}
+	var res []*byte
 
-	// Traverse the linked list
-	for r.Next != nil {
-		r = r.Next
-		res = append(res, r.Addr)
+	// Traverse the linked list, overflow pages have no Addr
+	for r := record; r != nil; r = r.Next {
+		if r.Addr != nil {
+			res = append(res, r.Addr)
+		}
+		res = append(res, r.Page...)
 	}
 
 	return res
@@ -230,16 +439,26 @@ func (record *Record) extractDuplicateKeyRecords() []*byte {
 
 // Insert a record to the end of the record linked list
 func (record *Record) insert(addr *byte) {
-	r := record
-	for r.Next != nil {
-		r = r.Next
-		continue
-	}
-
+	r := record.tail()
 	r.Next = &Record{
 		Addr: addr,
 		Next: nil,
 	}
+	record.Tail = r.Next
+	record.Count++
+}
+
+// Get the last record of the linked list, without walking the list when possible
+func (record *Record) tail() *Record {
+	if record.Tail != nil {
+		return record.Tail
+	}
+
+	r := record
+	for r.Next != nil {
+		r = r.Next
+	}
+	return r
 }
 
 // Get the current key size of a node
@@ -247,7 +466,8 @@ func (node *Node) getKeySize() int {
 	count := 0
 
 	if node == nil {
-		panic("Node is nil")
+		// A missing node holds no keys
+		return 0
 	}
 
 	for _, value := range node.Key {
@@ -262,9 +482,7 @@ func (node *Node) getKeySize() int {
 
 // search the tree to locate the leaf node
 // return the leaf node the key is at
-func (tree *BPTree) locateLeaf(key uint32, verbose bool) (*Node, int) {
-	var keySize int
-
+func (tree *BPTree) locateLeaf(key uint64, verbose bool) (*Node, int) {
 	cursor := tree.Root
 	// Empty tree
 	if cursor == nil {
@@ -285,19 +503,7 @@ func (tree *BPTree) locateLeaf(key uint32, verbose bool) (*Node, int) {
 			}
 		}
 
-		keySize = cursor.getKeySize()
-
-		found := false
-		for i := 0; i < keySize; i++ {
-			if key < cursor.Key[i] {
-				cursor = cursor.Children[i]
-				found = true
-				break
-			}
-		}
-		if !found {
-			cursor = cursor.Children[keySize]
-		}
+		cursor = cursor.Children[childIndex(cursor, key)]
 	}
 
 	count++
@@ -325,20 +531,24 @@ func getSplitIndex(order int) int {
 // Create a non-leaf node
 func (tree *BPTree) newNode() *Node {
 	return &Node{
-		IsLeaf:   false,
-		Key:      make([]uint32, tree.Order-1),
-		Children: make([]*Node, tree.Order),
-		Parent:   nil,
+		IsLeaf:     false,
+		Key:        make([]uint64, tree.Order-1),
+		Children:   make([]*Node, tree.Order),
+		Parent:     nil,
+		wide:       tree.Duplicates == DuplicateUniquify,
+		compressed: tree.blockSize > 0,
 	}
 }
 
 // Create a leaf node
 func (tree *BPTree) newLeafNode() *Node {
 	return &Node{
-		IsLeaf:  true,
-		Key:     make([]uint32, tree.Order-1),
-		DataPtr: make([]*Record, tree.Order),
-		Parent:  nil,
+		IsLeaf:     true,
+		Key:        make([]uint64, tree.Order-1),
+		DataPtr:    make([]*Record, tree.Order),
+		Parent:     nil,
+		wide:       tree.Duplicates == DuplicateUniquify,
+		compressed: tree.blockSize > 0,
 	}
 }
 
@@ -349,7 +559,7 @@ func (tree *BPTree) newLeafNode() *Node {
 //
 
 // helper function to insert node/addr/key into their slice at target index
-func insertAt[T *Node | *Record | uint32](arr []T, value T, target int) {
+func insertAt[T *Node | *Record | uint64](arr []T, value T, target int) {
 
 	// Shift 1 position down the array
 	for i := len(arr) - 1; i >= 0; i-- {
@@ -362,96 +572,111 @@ func insertAt[T *Node | *Record | uint32](arr []T, value T, target int) {
 }
 
 // helper function to get the insertion index
-func getInsertIndex(keyList []uint32, key uint32) int {
+// Return errNodeFull if there's no empty slot for the key
+func getInsertIndex(keyList []uint64, key uint64) (int, error) {
 	for i, item := range keyList {
 		if item == 0 {
 			// 0 == nil in key list -> empty slot found
-			return i
+			return i, nil
 		}
 
 		if key < item {
-			return i
+			return i, nil
 		}
 	}
-	panic("Error: getInsertIndex()")
+	return -1, errNodeFull
 }
 
 // Insert into leaf, given a space in leaf
-func (node *Node) insertIntoLeaf(key uint32, addr *byte) {
-	targetIndex := getInsertIndex(node.Key, key)
-	insertAt(node.DataPtr, &Record{Addr: addr}, targetIndex) // insert ptr
-	insertAt(node.Key, key, targetIndex)                     // insert key
+func (node *Node) insertIntoLeaf(key uint64, addr *byte) error {
+	targetIndex, err := getInsertIndex(node.Key, key)
+	if err != nil {
+		return err
+	}
+	insertAt(node.DataPtr, newRecord(addr), targetIndex) // insert ptr
+	insertAt(node.Key, key, targetIndex)                 // insert key
+	return nil
 }
 
 // Split the node and insert
-func (tree *BPTree) splitAndInsertIntoLeaf(node *Node, key uint32, addr *byte) {
+func (tree *BPTree) splitAndInsertIntoLeaf(node *Node, key uint64, addr *byte) error {
 
-	tempKeys := make([]uint32, tree.Order) // Temp key's size is key + 1 (Order)
+	keySize := node.getKeySize()
+	tempKeys := make([]uint64, tree.Order) // Temp key's size is key + 1 (Order)
 	tempPointers := make([]*Record, tree.Order+1)
 	copy(tempKeys, node.Key)
 	copy(tempPointers, node.DataPtr)
 
-	targetIndex := getInsertIndex(tempKeys, key)
+	targetIndex, err := getInsertIndex(tempKeys, key)
+	if err != nil {
+		return err
+	}
 	insertAt(tempKeys, key, targetIndex)
-	insertAt(tempPointers, &Record{Addr: addr}, targetIndex)
+	insertAt(tempPointers, newRecord(addr), targetIndex)
 
-	splitIndex := getSplitIndex(tree.Order)
+	// A compressed node may split before all its slots are used
+	splitIndex := getSplitIndex(keySize + 1)
 
-	node.Key = make([]uint32, tree.Order-1)
+	node.Key = make([]uint64, tree.Order-1)
 	node.DataPtr = make([]*Record, tree.Order-1)
 	copy(node.Key, tempKeys[:splitIndex])
 	copy(node.DataPtr, tempPointers[:splitIndex])
 
 	// Create a new node on the right
 	newNode := tree.newNode() // Make a new node for the right side
-	newNode.Key = make([]uint32, tree.Order-1)
+	newNode.Key = make([]uint64, tree.Order-1)
 	newNode.DataPtr = make([]*Record, tree.Order-1)
-	copy(newNode.Key, tempKeys[splitIndex:])
-	copy(newNode.DataPtr, tempPointers[splitIndex:])
+	copy(newNode.Key, tempKeys[splitIndex:keySize+1])
+	copy(newNode.DataPtr, tempPointers[splitIndex:keySize+1])
 	newNode.Parent = node.Parent // new node shares the same parent as the left node
 	newNode.IsLeaf = true
 	newNode.Next = node.Next
 	node.Next = newNode
 
-	tree.insertIntoParent(node, newNode, newNode.Key[0])
+	return tree.insertIntoParent(node, newNode, tree.separator(node.Key[splitIndex-1], newNode.Key[0]))
 
 }
 
 // Insert into internal node, given a space in the node
-func (node *Node) insertIntoNode(key uint32, rightNode *Node) {
-	targetIndex := getInsertIndex(node.Key, key)
-	if key == 19 {
-		fmt.Printf("%v\n", targetIndex)
+func (node *Node) insertIntoNode(key uint64, rightNode *Node) error {
+	targetIndex, err := getInsertIndex(node.Key, key)
+	if err != nil {
+		return err
 	}
 	insertAt(node.Children, rightNode, targetIndex+1) // insert ptr
 	insertAt(node.Key, key, targetIndex)              // insert key
+	return nil
 }
 
-func (tree *BPTree) splitAndInsertIntoNode(node *Node, insertedNode *Node, key uint32) {
-	tempKeys := make([]uint32, tree.Order)
+func (tree *BPTree) splitAndInsertIntoNode(node *Node, insertedNode *Node, key uint64) error {
+	keySize := node.getKeySize()
+	tempKeys := make([]uint64, tree.Order)
 	tempPointers := make([]*Node, tree.Order+1)
 
 	copy(tempKeys, node.Key)
 	copy(tempPointers, node.Children)
 
-	insertIndex := getInsertIndex(tempKeys, key)
+	insertIndex, err := getInsertIndex(tempKeys, key)
+	if err != nil {
+		return err
+	}
 	insertAt(tempKeys, key, insertIndex)
 	insertAt(tempPointers, insertedNode, insertIndex+1)
 
-	splitIndex := getSplitIndex(tree.Order)
+	splitIndex := getSplitIndex(keySize + 1)
 
 	// Left node
-	node.Key = make([]uint32, tree.Order-1)
+	node.Key = make([]uint64, tree.Order-1)
 	node.Children = make([]*Node, tree.Order)
 	copy(node.Key, tempKeys[:splitIndex])
 	copy(node.Children, tempPointers[:splitIndex+1])
 
 	// Right node
 	newNode := tree.newNode() // Make a new node for the right side
-	newNode.Key = make([]uint32, tree.Order-1)
+	newNode.Key = make([]uint64, tree.Order-1)
 	newNode.Children = make([]*Node, tree.Order)
-	copy(newNode.Key, tempKeys[splitIndex+1:])
-	copy(newNode.Children, tempPointers[splitIndex+1:])
+	copy(newNode.Key, tempKeys[splitIndex+1:keySize+1])
+	copy(newNode.Children, tempPointers[splitIndex+1:keySize+2])
 	newNode.Parent = node.Parent // new node shares the same parent as the left node
 
 	for _, item := range newNode.Children {
@@ -464,11 +689,11 @@ func (tree *BPTree) splitAndInsertIntoNode(node *Node, insertedNode *Node, key u
 	ascendKey := tempKeys[splitIndex]
 	ascendPtr := newNode
 
-	tree.insertIntoParent(node, ascendPtr, ascendKey)
+	return tree.insertIntoParent(node, ascendPtr, ascendKey)
 
 }
 
-func (tree *BPTree) insertIntoParent(leftNode *Node, rightNode *Node, key uint32) {
+func (tree *BPTree) insertIntoParent(leftNode *Node, rightNode *Node, key uint64) error {
 	var insertIndex int
 	parent := leftNode.Parent
 
@@ -486,12 +711,12 @@ func (tree *BPTree) insertIntoParent(leftNode *Node, rightNode *Node, key uint32
 				item.Parent = parent
 			}
 		}
-	} else if parent.getKeySize() < tree.Order-1 {
-		parent.insertIntoNode(key, rightNode)
+	} else if tree.hasRoom(parent, key) {
+		return parent.insertIntoNode(key, rightNode)
 	} else {
-		tree.splitAndInsertIntoNode(parent, rightNode, key)
+		return tree.splitAndInsertIntoNode(parent, rightNode, key)
 	}
-
+	return nil
 }
 
 //
@@ -500,15 +725,115 @@ func (tree *BPTree) insertIntoParent(leftNode *Node, rightNode *Node, key uint32
 //
 //
 
+// Rebuild the whole tree from the leaf chain, packing the leaves evenly.
+// Used to rebalance once after removing many keys at a time.
+func (tree *BPTree) rebuild() {
+	var keys []uint64
+	var ptrs []*Record
+
+	node, _ := tree.locateLeaf(0, false)
+	for node != nil {
+		for i := 0; i < node.getKeySize(); i++ {
+			keys = append(keys, node.Key[i])
+			ptrs = append(ptrs, node.DataPtr[i])
+		}
+		node = tree.nextLeaf(node)
+	}
+
+	tree.build(keys, ptrs)
+}
+
+// Build the tree bottom up from sorted keys and their records
+func (tree *BPTree) build(keys []uint64, ptrs []*Record) {
+	if len(keys) == 0 {
+		tree.Root = nil
+		return
+	}
+
+	// Leaf level
+	var level []*Node
+	var lowKeys []uint64  // Smallest key in the subtree of each node in level
+	var highKeys []uint64 // Largest key in the subtree of each node in level
+	sizes := splitEvenly(len(keys), tree.Order-1)
+	if tree.blockSize > 0 {
+		sizes = tree.pack(keys, tree.Order-1, 0)
+	}
+	start := 0
+	for _, size := range sizes {
+		leaf := tree.newLeafNode()
+		copy(leaf.Key, keys[start:start+size])
+		copy(leaf.DataPtr, ptrs[start:start+size])
+		if len(level) > 0 {
+			level[len(level)-1].Next = leaf
+		}
+		level = append(level, leaf)
+		lowKeys = append(lowKeys, keys[start])
+		highKeys = append(highKeys, keys[start+size-1])
+		start += size
+	}
+
+	// Internal levels
+	for len(level) > 1 {
+		var parents []*Node
+		var parentLowKeys, parentHighKeys []uint64
+
+		// separators[i] separates level[i-1] from level[i]
+		separators := make([]uint64, len(level))
+		for i := 1; i < len(level); i++ {
+			separators[i] = tree.separator(highKeys[i-1], lowKeys[i])
+		}
+		sizes = splitEvenly(len(level), tree.Order)
+		if tree.blockSize > 0 {
+			sizes = tree.pack(separators, tree.Order, 1)
+		}
+
+		start = 0
+		for _, size := range sizes {
+			parent := tree.newNode()
+			for i := 0; i < size; i++ {
+				child := level[start+i]
+				child.Parent = parent
+				parent.Children[i] = child
+				if i > 0 {
+					parent.Key[i-1] = separators[start+i]
+				}
+			}
+			parents = append(parents, parent)
+			parentLowKeys = append(parentLowKeys, lowKeys[start])
+			parentHighKeys = append(parentHighKeys, highKeys[start+size-1])
+			start += size
+		}
+		level = parents
+		lowKeys = parentLowKeys
+		highKeys = parentHighKeys
+	}
+
+	level[0].Parent = nil
+	tree.Root = level[0]
+}
+
+// Split n items into the fewest groups of at most max items, with group sizes differing by at most 1
+func splitEvenly(n int, max int) []int {
+	groups := (n + max - 1) / max
+	sizes := make([]int, groups)
+	for i := range sizes {
+		sizes[i] = n / groups
+		if i < n%groups {
+			sizes[i]++
+		}
+	}
+	return sizes
+}
+
 // helper function to remove node/addr/key into their slice at target index
-func removeAt[T *Node | *Record | uint32](arr []T, target int) {
+func removeAt[T *Node | *Record | uint64](arr []T, target int) {
 	// Shift item forward by 1
 	for i := target + 1; i < len(arr); i++ {
 		arr[i-1] = arr[i]
 	}
 }
 
-func (node *Node) delete(key uint32) {
+func (node *Node) delete(key uint64) error {
 	var target int
 
 	found := false
@@ -521,7 +846,7 @@ func (node *Node) delete(key uint32) {
 	}
 
 	if !found {
-		panic("Key does not exist")
+		return ErrKeyNotFound
 	}
 
 	removeAt(node.Key, target)
@@ -531,7 +856,7 @@ func (node *Node) delete(key uint32) {
 		node.DataPtr[len(node.DataPtr)-1] = nil
 
 		// Update the parent's key if the key deleted is the first
-		if target == 0 && node.getKeySize() != 0 {
+		if target == 0 && node.getKeySize() != 0 && node.Parent != nil {
 			for i, item := range node.Parent.Key {
 				if item == key {
 					node.Parent.Key[i] = node.Key[0]
@@ -543,76 +868,90 @@ func (node *Node) delete(key uint32) {
 		removeAt(node.Children, target+1)
 		node.Children[len(node.Children)-1] = nil
 	}
-
+	return nil
 }
 
-func (tree *BPTree) deleteKey(node *Node, key uint32) {
+func (tree *BPTree) deleteKey(node *Node, key uint64) error {
 	var minKey int
+	if tree.cow {
+		return tree.deleteCOW(key)
+	}
 
-	node.delete(key)
+	if err := node.delete(key); err != nil {
+		return err
+	}
 
 	if tree.Root == node {
 		// Tree is root
-		if node.getKeySize() >= 0 {
-			return
+		if node.getKeySize() > 0 {
+			return nil
 		}
 
 		if node.IsLeaf {
 			// Tree is empty
 			tree.Root = nil
 		} else {
-			//move the first child up to become root
+			//move the only child up to become root
 			tree.Root = node.Children[0]
-			node.Parent = nil
+			tree.Root.Parent = nil
 		}
-		return
+		return nil
 	}
 
 	if node.IsLeaf {
-		minKey = tree.Order / 2 // floor( (n+1)/2 )
+		minKey = tree.minOrder() / 2 // floor( (n+1)/2 )
 	} else {
-		minKey = (tree.Order - 1) / 2 // floor( n/2 )
+		minKey = (tree.minOrder() - 1) / 2 // floor( n/2 )
 	}
 
 	keySize := node.getKeySize()
 	if keySize >= minKey {
 		// Enough keys
-		return
+		return nil
 	}
 
 	availableNode, isPrev, mergeableNode := node.findAvailableNeighbour(minKey)
 
-	//if key == 42 {
-	//	fmt.Printf("%v %v %v", availableNode, isPrev, mergeableNode)
-	//}
-
 	if availableNode == nil {
 		// Can't borrow anything, merging is needed
-		tree.mergeNode(node, mergeableNode, isPrev)
-	} else {
-		// Borrow 1 from neighbour
-		node.borrowFromNode(availableNode, isPrev)
+		if isPrev {
+			return tree.mergeNode(mergeableNode, node)
+		}
+		return tree.mergeNode(node, mergeableNode)
 	}
 
-	//fmt.Printf("Neighbour: %v\n", neighbour)
+	// Borrow 1 from neighbour
+	node.borrowFromNode(availableNode, isPrev)
+	if !tree.fits(node) || !tree.fits(node.Parent) {
+		// A separator key may outgrow the compressed page it's moved into
+		tree.rebuild()
+	}
+	return nil
+}
+
+// Get the index of node in its parent's children
+func (node *Node) indexInParent() int {
+	for i, item := range node.Parent.Children {
+		if item == node {
+			return i
+		}
+	}
+	return -1
 }
 
 // Find a neighbouring node that can borrow a node
-// Return the available node (can be nil) and left & right neighbours
+// Return the available node (can be nil), whether it's the left neighbour, and the neighbour to merge with otherwise
 func (node *Node) findAvailableNeighbour(minKey int) (available *Node, isPrev bool, mergeable *Node) {
 	var left, right *Node
-	for i, item := range node.Parent.Children {
-		if item == node {
-			if i != 0 {
-				// node is not the first node
-				left = node.Parent.Children[i-1]
-			}
 
-			if i < len(node.Parent.Children)-1 {
-				// node is not the last node
-				right = node.Parent.Children[i+1]
-			}
-		}
+	i := node.indexInParent()
+	if i > 0 {
+		// node is not the first node
+		left = node.Parent.Children[i-1]
+	}
+	if i < node.Parent.getKeySize() {
+		// node is not the last node
+		right = node.Parent.Children[i+1]
 	}
 
 	if left != nil && left.getKeySize()-1 >= minKey {
@@ -626,122 +965,87 @@ func (node *Node) findAvailableNeighbour(minKey int) (available *Node, isPrev bo
 	// No available node to borrow, return mergeable node
 	if left != nil {
 		return nil, true, left
-	} else {
-		return nil, false, right
 	}
+	return nil, false, right
 }
 
-func (tree *BPTree) mergeNode(node *Node, mergeInto *Node, isPrev bool) {
-	tempKeys := make([]uint32, len(node.Key))
-
-	if node.IsLeaf {
-		tempPtrs := make([]*Record, len(node.DataPtr))
-		if isPrev {
-			copy(tempKeys[:mergeInto.getKeySize()], mergeInto.Key[:mergeInto.getKeySize()])
-			copy(tempKeys[mergeInto.getKeySize():], node.Key)
-
-			copy(tempPtrs[:mergeInto.getKeySize()], mergeInto.DataPtr[:mergeInto.getKeySize()])
-			copy(tempPtrs[mergeInto.getKeySize():], node.DataPtr)
-
-			// Fix next pointer
-			for _, item := range node.Parent.Children {
-				if item == nil {
-					break
-				}
-
-				if item.Next == mergeInto {
-					item.Next = node
-					break
-				}
-			}
-		} else {
-			copy(tempKeys[:node.getKeySize()], node.Key[:node.getKeySize()])
-			copy(tempKeys[mergeInto.getKeySize()-1:], mergeInto.Key[:mergeInto.getKeySize()])
-			copy(tempPtrs[:node.getKeySize()], node.DataPtr[:node.getKeySize()])
-			copy(tempPtrs[mergeInto.getKeySize()-1:], mergeInto.DataPtr[:mergeInto.getKeySize()])
-			node.Next = mergeInto.Next
-		}
-
-		node.Key = tempKeys
-		node.DataPtr = tempPtrs
-
-		var deleteKey uint32
-		for i, item := range mergeInto.Parent.Children {
-			if item == mergeInto {
-				if isPrev {
-					deleteKey = mergeInto.Parent.Key[i]
-					node.Parent.Children[i] = node
-				} else {
-					deleteKey = mergeInto.Parent.Key[i-1]
-					node.Parent.Children[i] = node
-				}
-			}
+// Merge right into left, its neighbour on the right, then remove the separator key and right from the parent
+func (tree *BPTree) mergeNode(left *Node, right *Node) error {
+	leftSize := left.getKeySize()
+	rightSize := right.getKeySize()
+	separatorIndex := right.indexInParent() - 1
+	separator := left.Parent.Key[separatorIndex]
+
+	if left.IsLeaf {
+		copy(left.Key[leftSize:], right.Key[:rightSize])
+		copy(left.DataPtr[leftSize:], right.DataPtr[:rightSize])
+		left.Next = right.Next
+	} else {
+		// The separator key comes down between the keys of both nodes
+		left.Key[leftSize] = separator
+		copy(left.Key[leftSize+1:], right.Key[:rightSize])
+		copy(left.Children[leftSize+1:], right.Children[:rightSize+1])
+		for _, item := range right.Children[:rightSize+1] {
+			item.Parent = left
 		}
+	}
 
-		tree.deleteKey(mergeInto.Parent, deleteKey)
+	if err := tree.deleteKey(left.Parent, separator); err != nil {
+		return err
+	}
+	if !tree.fits(left) {
+		// Merged keys may share a shorter prefix than before, and outgrow the compressed page
+		tree.rebuild()
 	}
+	return nil
 }
 
+// Move 1 key from borrowFrom, the left neighbour if isPrev, into node
 func (node *Node) borrowFromNode(borrowFrom *Node, isPrev bool) {
-	var insertIndex, removeIndex int
-	var parentKey, parentReplaceKey uint32
-
-	if isPrev {
-		// Move the last item of borrowFrom to first item of node
-		insertIndex = 0
-		removeIndex = borrowFrom.getKeySize() - 1
-		parentKey = node.Key[0]
-		parentReplaceKey = borrowFrom.Key[borrowFrom.getKeySize()-1]
-	} else {
-		// Move the first item of borrowFrom to the last item of node
-		insertIndex = node.getKeySize() - 1
-		removeIndex = 0
-		parentKey = borrowFrom.Key[0]
-		parentReplaceKey = borrowFrom.Key[1]
-	}
-
-	insertAt(node.Key, borrowFrom.Key[removeIndex], insertIndex)
-	removeAt(borrowFrom.Key, removeIndex)
-	borrowFrom.Key[len(borrowFrom.Key)-1] = 0 // set last index as nil
+	keySize := node.getKeySize()
+	borrowSize := borrowFrom.getKeySize()
+	parent := node.Parent
+	i := node.indexInParent()
 
 	if node.IsLeaf {
-
-		insertAt(node.DataPtr, borrowFrom.DataPtr[removeIndex], insertIndex)
-		removeAt(borrowFrom.DataPtr, removeIndex)
-		borrowFrom.DataPtr[len(borrowFrom.DataPtr)-1] = nil // set last index as nil
-
-		//Fix parent's key
-		for i, item := range node.Parent.Key {
-			if item == parentKey {
-				node.Parent.Key[i] = parentReplaceKey
-				break
-			}
-		}
-	} else {
 		if isPrev {
-			insertAt(node.Children, borrowFrom.Children[removeIndex+1], insertIndex)
+			// Move the last item of borrowFrom to first item of node
+			insertAt(node.Key, borrowFrom.Key[borrowSize-1], 0)
+			insertAt(node.DataPtr, borrowFrom.DataPtr[borrowSize-1], 0)
+			borrowFrom.Key[borrowSize-1] = 0
+			borrowFrom.DataPtr[borrowSize-1] = nil
+			parent.Key[i-1] = node.Key[0]
 		} else {
-			insertAt(node.Children, borrowFrom.Children[removeIndex+1], insertIndex+1)
-		}
-
-		removeAt(borrowFrom.Children, removeIndex+1)
-		borrowFrom.Children[len(borrowFrom.Children)-1] = nil // set last index as nil
-
-		//Fix parent's key
-		for i, item := range node.Parent.Children {
-			if item == node {
-				if isPrev {
-					temp := node.Parent.Key[i-1]
-					node.Parent.Key[i-1] = parentReplaceKey
-					node.Key[0] = temp
-				} else {
-					temp := node.Parent.Key[i]
-					node.Parent.Key[i] = parentReplaceKey
-					node.Key[node.getKeySize()-1] = temp
-				}
-				break
-			}
+			// Move the first item of borrowFrom to the last item of node
+			node.Key[keySize] = borrowFrom.Key[0]
+			node.DataPtr[keySize] = borrowFrom.DataPtr[0]
+			removeAt(borrowFrom.Key, 0)
+			removeAt(borrowFrom.DataPtr, 0)
+			borrowFrom.Key[len(borrowFrom.Key)-1] = 0 // set last index as nil
+			borrowFrom.DataPtr[len(borrowFrom.DataPtr)-1] = nil
+			parent.Key[i] = borrowFrom.Key[0]
 		}
+		return
 	}
 
+	// Internal node, the key rotates through the parent
+	if isPrev {
+		child := borrowFrom.Children[borrowSize]
+		insertAt(node.Key, parent.Key[i-1], 0)
+		insertAt(node.Children, child, 0)
+		child.Parent = node
+		parent.Key[i-1] = borrowFrom.Key[borrowSize-1]
+		borrowFrom.Key[borrowSize-1] = 0
+		borrowFrom.Children[borrowSize] = nil
+	} else {
+		child := borrowFrom.Children[0]
+		node.Key[keySize] = parent.Key[i]
+		node.Children[keySize+1] = child
+		child.Parent = node
+		parent.Key[i] = borrowFrom.Key[0]
+		removeAt(borrowFrom.Key, 0)
+		removeAt(borrowFrom.Children, 0)
+		borrowFrom.Key[len(borrowFrom.Key)-1] = 0 // set last index as nil
+		borrowFrom.Children[len(borrowFrom.Children)-1] = nil
+	}
 }
@@ -0,0 +1,189 @@
+package bptree
+
+import "encoding/binary"
+
+// Key compression
+// Keys are stored big-endian, so the keys of a node usually share their leading bytes, e.g. the tconst keys
+// of a leaf only differ in their last byte. A compressed node page stores that common prefix once,
+// then every key as a suffix of the same width, with trailing zero bytes dropped:
+// IsLeaf, NumKeys, Parent: header - 11 bytes
+// Prefix length, suffix width: 1 byte each
+// Prefix: prefix length bytes
+// Ptr-Suffix-Ptr-...-Suffix-Ptr: NumKeys suffixes of suffix width bytes
+// Separator keys of internal nodes are truncated to the shortest key telling both children apart,
+// so their trailing bytes are zero and dropped from the page as well.
+// Nodes split once their page would outgrow the block, rather than after a fixed number of keys.
+
+// Prefix length and suffix width of a compressed page
+const compressedHeaderSize = HeaderSize + 2
+
+// WithKeyCompression Compress the keys of the nodes, packing as many keys as fit in blockSize
+// Order is then derived from blockSize, as the most keys a node can hold with 1 byte suffixes.
+func WithKeyCompression(blockSize int) Option {
+	return func(tree *BPTree) {
+		tree.blockSize = blockSize
+	}
+}
+
+// Size in bytes of a key in the page format of the tree
+func (tree *BPTree) keySize() int {
+	if tree.Duplicates == DuplicateUniquify {
+		return WideKeySize
+	}
+	return KeySize
+}
+
+// Set the orders of a tree with key compression
+func (tree *BPTree) initCompression() {
+	tree.Order = OrderForBlockSize(tree.blockSize, 1, PtrSize, compressedHeaderSize)
+	tree.baseOrder = OrderForBlockSize(tree.blockSize, tree.keySize(), PtrSize, HeaderSize)
+}
+
+// Order bounding the number of keys when rebalancing
+// A compressed tree rebalances as if its keys weren't compressed, so that merged nodes still fit in a block.
+func (tree *BPTree) minOrder() int {
+	if tree.blockSize > 0 {
+		return tree.baseOrder
+	}
+	return tree.Order
+}
+
+// Check whether key can be inserted into node without splitting it
+func (tree *BPTree) hasRoom(node *Node, key uint64) bool {
+	keySize := node.getKeySize()
+	if keySize >= tree.Order-1 {
+		return false
+	}
+	if tree.blockSize == 0 {
+		return true
+	}
+	keys := append(append([]uint64{}, node.Key[:keySize]...), key)
+	return encodedSize(keys, node.wide, true) <= tree.blockSize
+}
+
+// Check whether the page of node fits in a block
+func (tree *BPTree) fits(node *Node) bool {
+	return tree.blockSize == 0 || node.EncodedSize() <= tree.blockSize
+}
+
+// Separator key between a node with largest key left and its right neighbour with smallest key right
+// With key compression it's truncated to the key with the most trailing zero bytes in (left, right].
+func (tree *BPTree) separator(left uint64, right uint64) uint64 {
+	if tree.blockSize == 0 {
+		return right
+	}
+	for shift := tree.keySize()*8 - 8; shift > 0; shift -= 8 {
+		if s := right >> shift << shift; s > left {
+			return s
+		}
+	}
+	return right
+}
+
+// Size of the page of a node holding keys
+func encodedSize(keys []uint64, wide bool, compressed bool) int {
+	width := KeySize
+	if wide {
+		width = WideKeySize
+	}
+	if !compressed {
+		return HeaderSize + len(keys)*width + (len(keys)+1)*PtrSize
+	}
+
+	prefix, suffix := compressKeys(keys, width)
+	return compressedHeaderSize + prefix + len(keys)*suffix + (len(keys)+1)*PtrSize
+}
+
+// Get the length of the prefix shared by keys, and the width of their suffixes without trailing zero bytes
+func compressKeys(keys []uint64, width int) (prefix int, suffix int) {
+	if len(keys) == 0 {
+		return 0, 0
+	}
+
+	bytes := make([][]byte, len(keys))
+	for i, key := range keys {
+		bytes[i] = make([]byte, 8)
+		binary.BigEndian.PutUint64(bytes[i], key)
+		bytes[i] = bytes[i][8-width:]
+	}
+
+	prefix = width
+	significant := 0
+	for _, b := range bytes {
+		n := 0
+		for n < prefix && b[n] == bytes[0][n] {
+			n++
+		}
+		prefix = n
+
+		end := width
+		for end > 0 && b[end-1] == 0 {
+			end--
+		}
+		if end > significant {
+			significant = end
+		}
+	}
+
+	if significant < prefix {
+		return prefix, 0
+	}
+	return prefix, significant - prefix
+}
+
+// Fanout Get the average number of children of the internal nodes, and of keys of the leaves
+func (tree *BPTree) Fanout() (internal float64, leaf float64) {
+	var nodes, children, leaves, keys int
+	level := []*Node{tree.Root}
+	for len(level) > 0 && level[0] != nil {
+		var next []*Node
+		for _, node := range level {
+			keySize := node.getKeySize()
+			if node.IsLeaf {
+				leaves++
+				keys += keySize
+				continue
+			}
+			nodes++
+			children += keySize + 1
+			next = append(next, node.Children[:keySize+1]...)
+		}
+		level = next
+	}
+
+	if nodes > 0 {
+		internal = float64(children) / float64(nodes)
+	}
+	if leaves > 0 {
+		leaf = float64(keys) / float64(leaves)
+	}
+	return internal, leaf
+}
+
+// Split items into groups of at most max items whose compressed page fits in a block, filling every group in turn
+// The page of a group holds its items but the first skip ones, e.g. an internal node has no key for its first child.
+func (tree *BPTree) pack(items []uint64, max int, skip int) []int {
+	var sizes []int
+	for start := 0; start < len(items); {
+		size := 1
+		for start+size < len(items) && size < max &&
+			encodedSize(items[start+skip:start+size+1], tree.keySize() == WideKeySize, true) <= tree.blockSize {
+			size++
+		}
+		sizes = append(sizes, size)
+		start += size
+	}
+
+	// The last group only gets the items left, move items into it from the group before so that their sizes are
+	// as even as splitEvenly would make them, or as close as fits in a block
+	if n := len(sizes); n > 1 {
+		total := sizes[n-2] + sizes[n-1]
+		for last := total / 2; last > sizes[n-1]; last-- {
+			if encodedSize(items[len(items)-last+skip:], tree.keySize() == WideKeySize, true) <= tree.blockSize {
+				sizes[n-2], sizes[n-1] = total-last, last
+				break
+			}
+		}
+	}
+	return sizes
+}
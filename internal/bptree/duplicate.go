@@ -0,0 +1,219 @@
+package bptree
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DuplicateStrategy decides how records sharing the same key are stored
+type DuplicateStrategy int
+
+const (
+	// DuplicateList Chain every record of the key in a linked list hanging off DataPtr[i] (default)
+	DuplicateList DuplicateStrategy = iota
+	// DuplicateOverflow Store the record IDs of the key in overflow pages of Order record IDs each
+	DuplicateOverflow
+	// DuplicateUniquify Make every key unique by appending the record ID given by WithRecordIDs to it,
+	// duplicates become separate keys
+	DuplicateUniquify
+	// DuplicateReject Reject duplicate keys, for unique indexes
+	DuplicateReject
+)
+
+var ErrDuplicateKey = errors.New("key already exists")
+
+// DuplicateKeyError Unique constraint violation, carrying the record already stored with the key
+// errors.Is(err, ErrDuplicateKey) holds for it
+type DuplicateKeyError struct {
+	Key  uint32
+	Addr *byte // Address of the conflicting record
+}
+
+func (e *DuplicateKeyError) Error() string {
+	return fmt.Sprintf("key %v already exists (record %v)", e.Key, e.Addr)
+}
+
+func (e *DuplicateKeyError) Is(target error) bool {
+	return target == ErrDuplicateKey
+}
+
+// Option configures the tree at New
+type Option func(tree *BPTree)
+
+// WithDuplicates Select how duplicate keys are handled
+func WithDuplicates(strategy DuplicateStrategy) Option {
+	return func(tree *BPTree) {
+		tree.Duplicates = strategy
+	}
+}
+
+// WithRecordIDs Derive the record ID appended to the keys from the address of the record, for DuplicateUniquify
+// recordID has to be unique per record, e.g. its block index * records per block + its slot.
+func WithRecordIDs(recordID func(addr *byte) uint32) Option {
+	return func(tree *BPTree) {
+		tree.recordID = recordID
+	}
+}
+
+// WithUnique Make the tree a unique index, Insert fails with a DuplicateKeyError on an existing key
+func WithUnique() Option {
+	return WithDuplicates(DuplicateReject)
+}
+
+// Upsert Insert the key, or replace the record(s) of the key if it exists
+// Return the addresses of the replaced records, nil if the key was inserted
+func (tree *BPTree) Upsert(key uint32, addr *byte) ([]*byte, error) {
+	if tree.readOnly {
+		return nil, ErrReadOnly
+	}
+	if tree.Duplicates == DuplicateUniquify {
+		replaced, err := tree.DeleteRange(key, key)
+		if err != nil {
+			return replaced, err
+		}
+		return replaced, tree.Insert(key, addr)
+	}
+
+	node, index := tree.find(key)
+	if node == nil {
+		return nil, tree.Insert(key, addr)
+	}
+
+	replaced := node.DataPtr[index].extractDuplicateKeyRecords()
+	if tree.cow {
+		node = tree.copyPath(uint64(key))
+	}
+	node.DataPtr[index] = newRecord(addr)
+	return replaced, nil
+}
+
+// InsertIfAbsent Insert the key only if it doesn't exist yet
+// Return the address of the existing record if the key exists, nil if the key was inserted
+func (tree *BPTree) InsertIfAbsent(key uint32, addr *byte) (*byte, error) {
+	if tree.readOnly {
+		return nil, ErrReadOnly
+	}
+	if tree.Duplicates == DuplicateUniquify {
+		if existing := tree.Search(key, false); len(existing) > 0 {
+			return existing[0], nil
+		}
+		return nil, tree.Insert(key, addr)
+	}
+
+	node, index := tree.find(key)
+	if node != nil {
+		return node.DataPtr[index].Addr, nil
+	}
+	return nil, tree.Insert(key, addr)
+}
+
+// DeleteRecord Remove a single record of the key, the key itself is removed with its last record
+// Used to keep an index in sync when a record is deleted through another index.
+// Return ErrKeyNotFound if the record isn't stored under the key
+func (tree *BPTree) DeleteRecord(key uint32, addr *byte) error {
+	if tree.readOnly {
+		return ErrReadOnly
+	}
+	if tree.Root == nil {
+		return ErrKeyNotFound
+	}
+
+	// Every record has its own key with DuplicateUniquify
+	k, err := tree.recordKey(key, addr)
+	if err != nil {
+		return err
+	}
+	node, index := tree.findKey(k)
+	if node == nil {
+		return ErrKeyNotFound
+	}
+
+	var remaining []*byte
+	for _, item := range node.DataPtr[index].extractDuplicateKeyRecords() {
+		if item != addr {
+			remaining = append(remaining, item)
+		}
+	}
+	if len(remaining) == node.DataPtr[index].Count {
+		return ErrKeyNotFound
+	}
+	if len(remaining) == 0 {
+		return tree.deleteKey(node, k)
+	}
+
+	// Rebuild the chain without the record
+	if tree.cow {
+		node = tree.copyPath(k)
+	}
+	node.DataPtr[index] = tree.newChain(remaining)
+	return nil
+}
+
+// Locate the leaf and the index of key in it, nil if the key doesn't exist
+func (tree *BPTree) find(key uint32) (*Node, int) {
+	return tree.findKey(uint64(key))
+}
+
+// Locate the leaf and the index of the key stored in the tree, nil if it doesn't exist
+func (tree *BPTree) findKey(k uint64) (*Node, int) {
+	if tree.Root == nil {
+		return nil, 0
+	}
+
+	node, _ := tree.locateLeaf(k, false)
+	for i := 0; i < node.getKeySize(); i++ {
+		if node.Key[i] == k {
+			return node, i
+		}
+	}
+	return nil, 0
+}
+
+// Insert a record ID into the last overflow page, a new page is chained when it is full
+func (record *Record) insertIntoPage(addr *byte, pageSize int) {
+	r := record.tail()
+	if r == record || len(r.Page) >= pageSize {
+		r.Next = &Record{
+			Page: make([]*byte, 0, pageSize),
+		}
+		r = r.Next
+		record.Tail = r
+	}
+	r.Page = append(r.Page, addr)
+	record.Count++
+}
+
+// Get the key stored in the tree for the record at addr, with its record ID appended for DuplicateUniquify
+func (tree *BPTree) recordKey(key uint32, addr *byte) (uint64, error) {
+	if tree.Duplicates != DuplicateUniquify {
+		return uint64(key), nil
+	}
+	if tree.recordID == nil {
+		return 0, errNoRecordIDs
+	}
+	return uint64(key)<<32 | uint64(tree.recordID(addr)), nil
+}
+
+// Get the smallest key stored in the tree for key
+func (tree *BPTree) lowKey(key uint32) uint64 {
+	if tree.Duplicates == DuplicateUniquify {
+		return uint64(key) << 32
+	}
+	return uint64(key)
+}
+
+// Get the key given by the user from a key stored in the tree
+func (tree *BPTree) userKey(key uint64) uint32 {
+	if tree.Duplicates == DuplicateUniquify {
+		return uint32(key >> 32)
+	}
+	return uint32(key)
+}
+
+// Get the largest key stored in the tree for key
+func (tree *BPTree) highKey(key uint32) uint64 {
+	if tree.Duplicates == DuplicateUniquify {
+		return uint64(key)<<32 | 0xFFFFFFFF
+	}
+	return uint64(key)
+}
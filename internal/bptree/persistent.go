@@ -0,0 +1,424 @@
+package bptree
+
+import "errors"
+
+// Copy-on-write mode
+// Nodes are never modified once they are part of the tree: a write copies the nodes on the path from the root
+// to the leaf it changes, and the copied root becomes the new Root. Untouched subtrees are shared with the
+// previous versions, which stay valid as long as a Snapshot holds their root.
+// Shared nodes can't point to their parent or next leaf, so Parent and Next are left nil and the next leaf is
+// found from the root instead.
+
+var ErrReadOnly = errors.New("tree is a read-only snapshot")
+
+// WithCopyOnWrite Make every write path-copy the nodes it changes, see Snapshot
+func WithCopyOnWrite() Option {
+	return func(tree *BPTree) {
+		tree.cow = true
+	}
+}
+
+// Snapshot Get a read-only version of the tree as of now, unaffected by later writes
+// A copy-on-write tree shares its nodes with the snapshot, any other tree is copied.
+func (tree *BPTree) Snapshot() *BPTree {
+	snapshot := *tree
+	snapshot.readOnly = true
+	snapshot.NodesAccessed = 0
+	if tree.cow || tree.Root == nil {
+		return &snapshot
+	}
+
+	// Nodes and records are modified in place, copy them
+	var keys []uint64
+	var ptrs []*Record
+	for node, _ := tree.locateLeaf(0, false); node != nil; node = node.Next {
+		for i := 0; i < node.getKeySize(); i++ {
+			keys = append(keys, node.Key[i])
+			ptrs = append(ptrs, tree.newChain(node.DataPtr[i].extractDuplicateKeyRecords()))
+		}
+	}
+	snapshot.build(keys, ptrs)
+	return &snapshot
+}
+
+// Get the leaf after node, nil for the last leaf
+func (tree *BPTree) nextLeaf(node *Node) *Node {
+	if !tree.cow {
+		return node.Next
+	}
+
+	keySize := node.getKeySize()
+	if keySize == 0 {
+		return nil
+	}
+
+	// The next leaf is the leftmost leaf of the closest subtree on the right of the path to node
+	key := node.Key[keySize-1]
+	var next *Node
+	for cursor := tree.Root; !cursor.IsLeaf; {
+		i := childIndex(cursor, key)
+		if i < cursor.getKeySize() {
+			next = cursor.Children[i+1]
+		}
+		cursor = cursor.Children[i]
+	}
+	for next != nil && !next.IsLeaf {
+		next = next.Children[0]
+	}
+	return next
+}
+
+// Get the index of the child of node holding key
+func childIndex(node *Node, key uint64) int {
+	keySize := node.getKeySize()
+	for i := 0; i < keySize; i++ {
+		if key < node.Key[i] {
+			return i
+		}
+	}
+	return keySize
+}
+
+// Copy node, without its Parent and Next pointers
+func (node *Node) clone() *Node {
+	c := *node
+	c.Key = append([]uint64(nil), node.Key...)
+	if node.Children != nil {
+		c.Children = append([]*Node(nil), node.Children...)
+	}
+	if node.DataPtr != nil {
+		c.DataPtr = append([]*Record(nil), node.DataPtr...)
+	}
+	c.Parent = nil
+	c.Next = nil
+	return &c
+}
+
+// Chain the records of a key, as stored by the duplicate strategy of the tree
+func (tree *BPTree) newChain(addrs []*byte) *Record {
+	record := newRecord(addrs[0])
+	for _, addr := range addrs[1:] {
+		if tree.Duplicates == DuplicateOverflow {
+			record.insertIntoPage(addr, tree.Order)
+		} else {
+			record.insert(addr)
+		}
+	}
+	return record
+}
+
+// Add addr to the chain of head without modifying it, return the head of the new chain
+// The new chain shares the records of head but its first one, or first overflow page, which keeps duplicate
+// inserts from copying every record of the key.
+func (tree *BPTree) prependRecord(head *Record, addr *byte) *Record {
+	if tree.Duplicates != DuplicateOverflow {
+		return &Record{Addr: addr, Next: head, Tail: head.tail(), Count: head.Count + 1}
+	}
+
+	// addr goes into a copy of the first page if it has room, or into a new page before it
+	first := head.Next
+	page := &Record{Page: make([]*byte, 0, tree.Order), Next: first}
+	if first != nil && len(first.Page) < tree.Order {
+		page.Page = append(page.Page, first.Page...)
+		page.Next = first.Next
+	}
+	page.Page = append(page.Page, addr)
+
+	tail := head.Tail
+	if page.Next == nil {
+		tail = page
+	}
+	return &Record{Addr: head.Addr, Next: page, Tail: tail, Count: head.Count + 1}
+}
+
+// Path copy the nodes from the root to the leaf of key into a new Root, return the copied leaf
+// The leaf can then be modified in place, e.g. to replace the records of a key.
+func (tree *BPTree) copyPath(key uint64) *Node {
+	tree.Root = tree.Root.clone()
+	node := tree.Root
+	for !node.IsLeaf {
+		i := childIndex(node, key)
+		node.Children[i] = node.Children[i].clone()
+		node = node.Children[i]
+	}
+	return node
+}
+
+// Insert key into a copy-on-write tree
+func (tree *BPTree) insertCOW(key uint32, k uint64, addr *byte) error {
+	if tree.Root == nil {
+		leaf := tree.newLeafNode()
+		leaf.Key[0] = k
+		leaf.DataPtr[0] = newRecord(addr)
+		tree.Root = leaf
+		return nil
+	}
+
+	node, _ := tree.locateLeaf(k, false)
+	for i := 0; i < node.getKeySize(); i++ {
+		if node.Key[i] != k {
+			continue
+		}
+		if tree.Duplicates == DuplicateReject {
+			return &DuplicateKeyError{Key: key, Addr: node.DataPtr[i].Addr}
+		}
+		// Records are shared with the previous versions too, addr goes in front of them
+		leaf := tree.copyPath(k)
+		leaf.DataPtr[i] = tree.prependRecord(node.DataPtr[i], addr)
+		return nil
+	}
+
+	left, right, separator := tree.insertCopy(tree.Root, k, addr)
+	if right == nil {
+		tree.Root = left
+		return nil
+	}
+	root := tree.newNode()
+	root.Key[0] = separator
+	root.Children[0] = left
+	root.Children[1] = right
+	tree.Root = root
+	return nil
+}
+
+// Insert key into a copy of the subtree of node
+// Return the copy, and if it split, the new node on its right with the separator key between them.
+func (tree *BPTree) insertCopy(node *Node, key uint64, addr *byte) (*Node, *Node, uint64) {
+	keySize := node.getKeySize()
+	if node.IsLeaf {
+		keys := make([]uint64, keySize+1)
+		ptrs := make([]*Record, keySize+1)
+		i := childIndex(node, key)
+		copy(keys, node.Key[:i])
+		copy(ptrs, node.DataPtr[:i])
+		keys[i], ptrs[i] = key, newRecord(addr)
+		copy(keys[i+1:], node.Key[i:keySize])
+		copy(ptrs[i+1:], node.DataPtr[i:keySize])
+
+		if tree.hasRoom(node, key) {
+			return tree.newLeaf(keys, ptrs), nil, 0
+		}
+		splitIndex := getSplitIndex(keySize + 1)
+		left, right := tree.newLeaf(keys[:splitIndex], ptrs[:splitIndex]), tree.newLeaf(keys[splitIndex:], ptrs[splitIndex:])
+		return left, right, tree.separator(keys[splitIndex-1], keys[splitIndex])
+	}
+
+	i := childIndex(node, key)
+	child, right, separator := tree.insertCopy(node.Children[i], key, addr)
+	if right == nil {
+		copied := node.clone()
+		copied.Children[i] = child
+		return copied, nil, 0
+	}
+
+	keys := make([]uint64, keySize+1)
+	children := make([]*Node, keySize+2)
+	copy(keys, node.Key[:i])
+	copy(children, node.Children[:i])
+	keys[i], children[i], children[i+1] = separator, child, right
+	copy(keys[i+1:], node.Key[i:keySize])
+	copy(children[i+2:], node.Children[i+1:keySize+1])
+
+	if tree.hasRoom(node, separator) {
+		return tree.newInternal(keys, children), nil, 0
+	}
+	splitIndex := getSplitIndex(keySize + 1)
+	left := tree.newInternal(keys[:splitIndex], children[:splitIndex+1])
+	newRight := tree.newInternal(keys[splitIndex+1:], children[splitIndex+1:])
+	return left, newRight, keys[splitIndex]
+}
+
+// Create a leaf holding keys and their records
+func (tree *BPTree) newLeaf(keys []uint64, ptrs []*Record) *Node {
+	leaf := tree.newLeafNode()
+	copy(leaf.Key, keys)
+	copy(leaf.DataPtr, ptrs)
+	return leaf
+}
+
+// Create an internal node holding keys and children
+func (tree *BPTree) newInternal(keys []uint64, children []*Node) *Node {
+	node := tree.newNode()
+	copy(node.Key, keys)
+	copy(node.Children, children)
+	return node
+}
+
+// Delete key from a copy-on-write tree
+func (tree *BPTree) deleteCOW(key uint64) error {
+	if tree.Root == nil {
+		return ErrKeyNotFound
+	}
+
+	root, err := tree.deleteCopy(tree.Root, key)
+	if err != nil {
+		return err
+	}
+	if root.getKeySize() == 0 {
+		if root.IsLeaf {
+			root = nil
+		} else {
+			root = root.Children[0]
+		}
+	}
+	tree.Root = root
+
+	if tree.repack {
+		// A rebalanced node outgrew its compressed page, the new nodes of the rebuild leave the old versions intact
+		tree.repack = false
+		tree.rebuild()
+	}
+	return nil
+}
+
+// Delete key from a copy of the subtree of node, return the copy
+// The copy may underflow, its parent rebalances it.
+func (tree *BPTree) deleteCopy(node *Node, key uint64) (*Node, error) {
+	keySize := node.getKeySize()
+	if node.IsLeaf {
+		for i := 0; i < keySize; i++ {
+			if node.Key[i] == key {
+				copied := node.clone()
+				removeAt(copied.Key, i)
+				removeAt(copied.DataPtr, i)
+				copied.Key[len(copied.Key)-1] = 0
+				copied.DataPtr[len(copied.DataPtr)-1] = nil
+				return copied, nil
+			}
+		}
+		return nil, ErrKeyNotFound
+	}
+
+	i := childIndex(node, key)
+	child, err := tree.deleteCopy(node.Children[i], key)
+	if err != nil {
+		return nil, err
+	}
+	copied := node.clone()
+	copied.Children[i] = child
+
+	minKey := (tree.minOrder() - 1) / 2 // floor( n/2 )
+	if child.IsLeaf {
+		minKey = tree.minOrder() / 2 // floor( (n+1)/2 )
+	}
+	if child.getKeySize() < minKey {
+		tree.rebalanceCopy(copied, i, minKey)
+	}
+	return copied, nil
+}
+
+// Rebalance child i of node, a copy, by borrowing from or merging with a copy of its neighbour
+func (tree *BPTree) rebalanceCopy(node *Node, i int, minKey int) {
+	child := node.Children[i]
+	left := i > 0
+	j := i + 1
+	if left {
+		j = i - 1
+	}
+	if !left && j > node.getKeySize() {
+		// Only child, the parent underflows in turn
+		return
+	}
+	neighbour := node.Children[j].clone()
+	node.Children[j] = neighbour
+
+	childSize, neighbourSize := child.getKeySize(), neighbour.getKeySize()
+	if neighbourSize-1 >= minKey {
+		// Borrow 1 from the neighbour
+		if child.IsLeaf {
+			if left {
+				insertAt(child.Key, neighbour.Key[neighbourSize-1], 0)
+				insertAt(child.DataPtr, neighbour.DataPtr[neighbourSize-1], 0)
+				neighbour.Key[neighbourSize-1] = 0
+				neighbour.DataPtr[neighbourSize-1] = nil
+				node.Key[i-1] = tree.separator(neighbour.Key[neighbourSize-2], child.Key[0])
+			} else {
+				child.Key[childSize] = neighbour.Key[0]
+				child.DataPtr[childSize] = neighbour.DataPtr[0]
+				removeAt(neighbour.Key, 0)
+				removeAt(neighbour.DataPtr, 0)
+				neighbour.Key[len(neighbour.Key)-1] = 0
+				neighbour.DataPtr[len(neighbour.DataPtr)-1] = nil
+				node.Key[i] = tree.separator(child.Key[childSize], neighbour.Key[0])
+			}
+		} else if left {
+			// The key rotates through the parent
+			insertAt(child.Key, node.Key[i-1], 0)
+			insertAt(child.Children, neighbour.Children[neighbourSize], 0)
+			node.Key[i-1] = neighbour.Key[neighbourSize-1]
+			neighbour.Key[neighbourSize-1] = 0
+			neighbour.Children[neighbourSize] = nil
+		} else {
+			child.Key[childSize] = node.Key[i]
+			child.Children[childSize+1] = neighbour.Children[0]
+			node.Key[i] = neighbour.Key[0]
+			removeAt(neighbour.Key, 0)
+			removeAt(neighbour.Children, 0)
+			neighbour.Key[len(neighbour.Key)-1] = 0
+			neighbour.Children[len(neighbour.Children)-1] = nil
+		}
+		if !tree.fits(child) || !tree.fits(node) {
+			tree.repack = true
+		}
+		return
+	}
+
+	// Merge the right node of the pair into the left one, and drop the separator between them
+	s := i
+	l, r := child, neighbour
+	if left {
+		s = j
+		l, r = neighbour, child
+	}
+	lSize, rSize := l.getKeySize(), r.getKeySize()
+	if l.IsLeaf {
+		copy(l.Key[lSize:], r.Key[:rSize])
+		copy(l.DataPtr[lSize:], r.DataPtr[:rSize])
+	} else {
+		l.Key[lSize] = node.Key[s]
+		copy(l.Key[lSize+1:], r.Key[:rSize])
+		copy(l.Children[lSize+1:], r.Children[:rSize+1])
+	}
+	removeAt(node.Key, s)
+	removeAt(node.Children, s+1)
+	node.Key[len(node.Key)-1] = 0
+	node.Children[len(node.Children)-1] = nil
+	if !tree.fits(l) {
+		tree.repack = true
+	}
+}
+
+// Delete the keys in [fromKey, toKey] from a copy-on-write tree, return the addresses of their records
+// On error the records of the keys deleted before it are returned.
+func (tree *BPTree) deleteRangeCOW(fromKey uint64, toKey uint64) ([]*byte, error) {
+	var records []*byte
+	var keys []uint64
+	var chains []*Record
+
+	node, count := tree.locateLeaf(fromKey, false)
+	for node != nil {
+		keySize := node.getKeySize()
+		for i := 0; i < keySize; i++ {
+			if node.Key[i] >= fromKey && node.Key[i] <= toKey {
+				keys = append(keys, node.Key[i])
+				chains = append(chains, node.DataPtr[i])
+			}
+		}
+		if keySize == 0 || node.Key[keySize-1] >= toKey {
+			break
+		}
+		node = tree.nextLeaf(node)
+		if node != nil {
+			count++
+		}
+	}
+	tree.NodesAccessed = count
+
+	for i, key := range keys {
+		if err := tree.deleteCOW(key); err != nil {
+			return records, err
+		}
+		records = append(records, chains[i].extractDuplicateKeyRecords()...)
+	}
+	return records, nil
+}
@@ -0,0 +1,156 @@
+package bptree
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// Records pointed to by the trees under test
+var testAddrs [4096]byte
+
+// Record ID of an address of testAddrs, for DuplicateUniquify
+func testRecordID(addr *byte) uint32 {
+	for i := range testAddrs {
+		if &testAddrs[i] == addr {
+			return uint32(i)
+		}
+	}
+	panic("address outside testAddrs")
+}
+
+var testOptions = map[string][]Option{
+	"list":       {WithDuplicates(DuplicateList)},
+	"overflow":   {WithDuplicates(DuplicateOverflow)},
+	"uniquify":   {WithDuplicates(DuplicateUniquify), WithRecordIDs(testRecordID)},
+	"unique":     {WithUnique()},
+	"compressed": {WithKeyCompression(64)},
+	"compressed uniquify": {
+		WithDuplicates(DuplicateUniquify), WithRecordIDs(testRecordID), WithKeyCompression(128),
+	},
+}
+
+// Check that tree holds the number of records of every key in ref
+func checkTree(t *testing.T, name string, tree *BPTree, ref map[uint32]int) {
+	t.Helper()
+	total := 0
+	for key, count := range ref {
+		total += count
+		if got := len(tree.Search(key, false)); got != count {
+			t.Errorf("%v: key %v has %v records, want %v", name, key, got, count)
+		}
+	}
+	if got := len(tree.SearchRange(1, 1<<31, false)); got != total {
+		t.Errorf("%v: SearchRange got %v records, want %v", name, got, total)
+	}
+	if got := tree.CountRange(1, 1<<31); got != total {
+		t.Errorf("%v: CountRange got %v records, want %v", name, got, total)
+	}
+}
+
+func TestCopyOnWrite(t *testing.T) {
+	for name, opts := range testOptions {
+		for seed := int64(0); seed < 3; seed++ {
+			t.Run(fmt.Sprintf("%v/%v", name, seed), func(t *testing.T) {
+				testCopyOnWrite(t, seed, opts)
+			})
+		}
+	}
+}
+
+// Apply random writes to a copy-on-write tree and to a reference map, taking snapshots on the way
+func testCopyOnWrite(t *testing.T, seed int64, opts []Option) {
+	rng := rand.New(rand.NewSource(seed))
+	tree := New(7, append(opts, WithCopyOnWrite())...)
+	ref := map[uint32]int{}
+
+	var snapshots []*BPTree
+	var snapshotRefs []map[uint32]int
+	for step := 0; step < 4000; step++ {
+		key := uint32(rng.Intn(300) + 1)
+		switch op := rng.Intn(10); {
+		case op < 6:
+			err := tree.Insert(key, &testAddrs[rng.Intn(len(testAddrs))])
+			if err == nil {
+				ref[key]++
+			} else if !errors.Is(err, ErrDuplicateKey) || ref[key] == 0 {
+				t.Fatalf("step %v: Insert(%v): %v", step, key, err)
+			}
+		case op < 8:
+			err := tree.Delete(key)
+			if (err == nil) != (ref[key] > 0) {
+				t.Fatalf("step %v: Delete(%v) with %v records: %v", step, key, ref[key], err)
+			}
+			delete(ref, key)
+		case op < 9:
+			found := tree.Search(key, false)
+			if len(found) == 0 {
+				continue
+			}
+			if err := tree.DeleteRecord(key, found[rng.Intn(len(found))]); err != nil {
+				t.Fatalf("step %v: DeleteRecord(%v): %v", step, key, err)
+			}
+			if ref[key]--; ref[key] == 0 {
+				delete(ref, key)
+			}
+		default:
+			to := key + uint32(rng.Intn(30))
+			deleted, err := tree.DeleteRange(key, to)
+			if err != nil {
+				t.Fatalf("step %v: DeleteRange(%v, %v): %v", step, key, to, err)
+			}
+			want := 0
+			for k := key; k <= to; k++ {
+				want += ref[k]
+				delete(ref, k)
+			}
+			if len(deleted) != want {
+				t.Fatalf("step %v: DeleteRange(%v, %v) deleted %v records, want %v", step, key, to, len(deleted), want)
+			}
+		}
+
+		if step%500 == 0 {
+			snapshotRef := map[uint32]int{}
+			for k, count := range ref {
+				snapshotRef[k] = count
+			}
+			snapshots = append(snapshots, tree.Snapshot())
+			snapshotRefs = append(snapshotRefs, snapshotRef)
+		}
+	}
+
+	checkTree(t, "tree", tree, ref)
+	for i, snapshot := range snapshots {
+		checkTree(t, fmt.Sprintf("snapshot %v", i), snapshot, snapshotRefs[i])
+		if err := snapshot.Insert(1, &testAddrs[0]); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("snapshot %v: Insert got %v, want ErrReadOnly", i, err)
+		}
+	}
+}
+
+func TestSnapshotOfPlainTree(t *testing.T) {
+	tree := New(4)
+	ref := map[uint32]int{}
+	for key := uint32(1); key <= 100; key++ {
+		if err := tree.Insert(key, &testAddrs[key]); err != nil {
+			t.Fatal(err)
+		}
+		ref[key] = 1
+	}
+
+	snapshot := tree.Snapshot()
+	for key := uint32(1); key <= 50; key++ {
+		if err := tree.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkTree(t, "snapshot", snapshot, ref)
+}
+
+func TestUniquifyNeedsRecordIDs(t *testing.T) {
+	tree := New(4, WithDuplicates(DuplicateUniquify))
+	if err := tree.Insert(1, &testAddrs[0]); !errors.Is(err, errNoRecordIDs) {
+		t.Errorf("Insert got %v, want errNoRecordIDs", err)
+	}
+}
@@ -0,0 +1,65 @@
+package bptree
+
+// PageReader Reads the pages of a range scan, e.g. through a buffer pool
+type PageReader interface {
+	// ReadLeaf Read leaf on demand, with the records addrs in range it references
+	ReadLeaf(leaf *Node, addrs []*byte)
+	// PrefetchLeaf Read leaf ahead, with the records addrs in range it references
+	PrefetchLeaf(leaf *Node, addrs []*byte)
+}
+
+// SearchRangePrefetch SearchRange reading every leaf through reader, keeping the next depth leaves of the range read ahead
+func (tree *BPTree) SearchRangePrefetch(fromKey uint32, toKey uint32, reader PageReader, depth int) []*byte {
+	from, to := tree.lowKey(fromKey), tree.highKey(toKey)
+	node, count := tree.locateLeaf(from, false)
+	tree.NodesAccessed = count
+	if node == nil || from > to {
+		return nil
+	}
+
+	var records []*byte
+	ahead, issued := node, 0 // Last leaf read ahead, and number of leaves read ahead past node
+	for {
+		for issued < depth {
+			next := tree.nextLeaf(ahead)
+			if next == nil || next.Key[0] > to {
+				break
+			}
+			ahead = next
+			reader.PrefetchLeaf(ahead, leafRecords(ahead, from, to))
+			issued++
+		}
+
+		addrs := leafRecords(node, from, to)
+		reader.ReadLeaf(node, addrs)
+		records = append(records, addrs...)
+
+		keySize := node.getKeySize()
+		next := tree.nextLeaf(node)
+		if next == nil || (keySize > 0 && node.Key[keySize-1] >= to) {
+			// Range reached
+			break
+		}
+		node = next
+		count++
+		if issued > 0 {
+			issued--
+		} else {
+			ahead = node
+		}
+	}
+
+	tree.NodesAccessed = count
+	return records
+}
+
+// Get the records of leaf with key in [from, to]
+func leafRecords(leaf *Node, from uint64, to uint64) []*byte {
+	var records []*byte
+	for i := 0; i < leaf.getKeySize(); i++ {
+		if leaf.Key[i] >= from && leaf.Key[i] <= to {
+			records = append(records, leaf.DataPtr[i].extractDuplicateKeyRecords()...)
+		}
+	}
+	return records
+}
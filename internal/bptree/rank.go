@@ -0,0 +1,68 @@
+package bptree
+
+// Order statistics answered from the index only, without touching the data blocks.
+// The leaves are walked through the leaf chain, the number of records of every key is kept on its first record.
+
+// CountRange Count the records with key in [fromKey, toKey]
+func (tree *BPTree) CountRange(fromKey uint32, toKey uint32) int {
+	from, to := tree.lowKey(fromKey), tree.highKey(toKey)
+	if tree.Root == nil || from > to {
+		return 0
+	}
+
+	total := 0
+	node, count := tree.locateLeaf(from, false)
+	for node != nil {
+		keySize := node.getKeySize()
+		for i := 0; i < keySize; i++ {
+			if node.Key[i] > to {
+				tree.NodesAccessed = count
+				return total
+			}
+			if node.Key[i] >= from {
+				total += node.DataPtr[i].Count
+			}
+		}
+
+		node = tree.nextLeaf(node)
+		if node != nil {
+			count++
+		}
+	}
+	tree.NodesAccessed = count
+	return total
+}
+
+// Rank Count the records with a key smaller than key
+func (tree *BPTree) Rank(key uint32) int {
+	if key == 0 {
+		return 0
+	}
+	return tree.CountRange(0, key-1)
+}
+
+// Select Get the k-th (0-based) record in key order, with its key
+// Return ErrKeyNotFound if there are k records or less
+func (tree *BPTree) Select(k int) (uint32, *byte, error) {
+	if k < 0 {
+		return 0, nil, ErrKeyNotFound
+	}
+
+	node, count := tree.locateLeaf(0, false)
+	for node != nil {
+		for i := 0; i < node.getKeySize(); i++ {
+			if k < node.DataPtr[i].Count {
+				tree.NodesAccessed = count
+				return tree.userKey(node.Key[i]), node.DataPtr[i].extractDuplicateKeyRecords()[k], nil
+			}
+			k -= node.DataPtr[i].Count
+		}
+
+		node = tree.nextLeaf(node)
+		if node != nil {
+			count++
+		}
+	}
+	tree.NodesAccessed = count
+	return 0, nil, ErrKeyNotFound
+}
@@ -0,0 +1,33 @@
+package bptree
+
+// Node page format, a node is stored in one block
+// IsLeaf: bool - 1 byte
+// NumKeys: uint16 - 2 bytes
+// Parent: ptr to parent - 8 bytes
+// Ptr-Key-Ptr-...-Key-Ptr: Order pointers and Order-1 keys, the last pointer of a leaf is Next
+// Empty slots are kept, so every node of a tree takes the same space.
+const (
+	KeySize     = 4         // uint32 key
+	WideKeySize = 8         // Key with the appended record ID, for DuplicateUniquify
+	PtrSize     = 8         // Pointer on a 64bit system
+	HeaderSize  = 1 + 2 + 8 // IsLeaf, NumKeys and Parent
+)
+
+// OrderForBlockSize Get the largest order whose node page fits in blockSize
+// A node of order n takes headerSize + (n-1) * keySize + n * ptrSize bytes. The tree needs an order of at least 3,
+// a smaller result means the block can't hold a node.
+func OrderForBlockSize(blockSize int, keySize int, ptrSize int, headerSize int) int {
+	if blockSize < headerSize {
+		return 0
+	}
+	return (blockSize - headerSize + keySize) / (keySize + ptrSize)
+}
+
+// EncodedSize Get the size of the node page in bytes
+// A compressed page only holds the keys in use, see WithKeyCompression.
+func (node *Node) EncodedSize() int {
+	if node.compressed {
+		return encodedSize(node.Key[:node.getKeySize()], node.wide, true)
+	}
+	return encodedSize(node.Key, node.wide, false)
+}
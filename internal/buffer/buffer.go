@@ -0,0 +1,101 @@
+// Package buffer contains a minimal LRU buffer pool, to measure the reads saved by caching and read-ahead
+package buffer
+
+import "container/list"
+
+// Stats Page accounting of a pool
+type Stats struct {
+	Reads        int // Pages requested on demand
+	Hits         int // Demand reads served from the pool
+	Misses       int // Demand reads waiting for the disk
+	Prefetches   int // Pages read ahead
+	PrefetchHits int // Demand reads served by a page read ahead, before it was evicted
+}
+
+// HitRate Get the share of demand reads served from the pool
+func (stats Stats) HitRate() float64 {
+	if stats.Reads == 0 {
+		return 0
+	}
+	return float64(stats.Hits) / float64(stats.Reads)
+}
+
+// PrefetchHitRate Get the share of pages read ahead that were used before being evicted
+func (stats Stats) PrefetchHitRate() float64 {
+	if stats.Prefetches == 0 {
+		return 0
+	}
+	return float64(stats.PrefetchHits) / float64(stats.Prefetches)
+}
+
+// Pool LRU pool of Capacity pages
+// Pages are identified by any comparable key, e.g. a node pointer or a block index.
+type Pool struct {
+	Capacity int
+	Stats    Stats
+
+	frames map[any]*list.Element
+	lru    *list.List // Front is the most recently used page
+}
+
+type frame struct {
+	page       any
+	prefetched bool // Read ahead and not requested yet
+}
+
+// New Create an empty pool of capacity pages
+func New(capacity int) *Pool {
+	return &Pool{
+		Capacity: capacity,
+		frames:   map[any]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// Read Request page on demand, loading it if it isn't in the pool
+// Return whether the page was in the pool.
+func (pool *Pool) Read(page any) bool {
+	pool.Stats.Reads++
+	if e, ok := pool.frames[page]; ok {
+		pool.Stats.Hits++
+		f := e.Value.(*frame)
+		if f.prefetched {
+			pool.Stats.PrefetchHits++
+			f.prefetched = false
+		}
+		pool.lru.MoveToFront(e)
+		return true
+	}
+
+	pool.Stats.Misses++
+	pool.load(&frame{page: page})
+	return false
+}
+
+// Prefetch Read page ahead of its demand read, nothing is done if it's already in the pool
+func (pool *Pool) Prefetch(page any) {
+	if _, ok := pool.frames[page]; ok {
+		return
+	}
+	pool.Stats.Prefetches++
+	pool.load(&frame{page: page, prefetched: true})
+}
+
+// Contains Check whether page is in the pool, without touching it
+func (pool *Pool) Contains(page any) bool {
+	_, ok := pool.frames[page]
+	return ok
+}
+
+// Load a page, evicting the least recently used one when the pool is full
+func (pool *Pool) load(f *frame) {
+	if pool.Capacity <= 0 {
+		return
+	}
+	if pool.lru.Len() >= pool.Capacity {
+		last := pool.lru.Back()
+		delete(pool.frames, last.Value.(*frame).page)
+		pool.lru.Remove(last)
+	}
+	pool.frames[f.page] = pool.lru.PushFront(f)
+}
@@ -0,0 +1,39 @@
+package buffer
+
+import (
+	"internal/bptree"
+	"internal/fs"
+)
+
+// Data block of a disk, as a page key
+type dataBlock struct {
+	disk  *fs.VirtualDisk
+	index int
+}
+
+// RangeReader Read the leaves of a range scan and the data blocks they reference through Pool
+// Pass it to BPTree.SearchRangePrefetch.
+type RangeReader struct {
+	Pool *Pool
+	Disk *fs.VirtualDisk // Disk of the indexed records
+}
+
+// ReadLeaf Read leaf, then the data blocks of addrs
+func (r RangeReader) ReadLeaf(leaf *bptree.Node, addrs []*byte) {
+	r.Pool.Read(leaf)
+	for _, addr := range addrs {
+		r.Pool.Read(r.block(addr))
+	}
+}
+
+// PrefetchLeaf Read leaf and the data blocks of addrs ahead
+func (r RangeReader) PrefetchLeaf(leaf *bptree.Node, addrs []*byte) {
+	r.Pool.Prefetch(leaf)
+	for _, addr := range addrs {
+		r.Pool.Prefetch(r.block(addr))
+	}
+}
+
+func (r RangeReader) block(addr *byte) dataBlock {
+	return dataBlock{disk: r.Disk, index: r.Disk.LuTable[addr].BlockIndex}
+}
@@ -0,0 +1,172 @@
+package fs
+
+import "errors"
+
+// Block allocation
+// A block whose records are all deleted is released: it's emptied and kept in the free list until newBlock reuses it.
+// The free bitmap tells whether a block is free without searching the list, e.g. to skip it during scans.
+// When no free block is left and the disk is at capacity, the capacity grows by Growth bytes if set.
+
+// IsFree Check whether block index is released and waiting to be reused
+func (disk *VirtualDisk) IsFree(index int) bool {
+	word := index / 64
+	return word < len(disk.freeMap) && disk.freeMap[word]&(1<<(index%64)) != 0
+}
+
+// FreeBlocks Get the number of released blocks
+func (disk *VirtualDisk) FreeBlocks() int {
+	return len(disk.freeList)
+}
+
+// Take a block from the free list, return false if it's empty
+func (disk *VirtualDisk) reuseBlock() (int, bool) {
+	if len(disk.freeList) == 0 {
+		return -1, false
+	}
+	index := disk.freeList[len(disk.freeList)-1]
+	disk.freeList = disk.freeList[:len(disk.freeList)-1]
+	disk.freeMap[index/64] &^= 1 << (index % 64)
+	return index, true
+}
+
+// Grow the capacity by Growth bytes, return false if the disk can't grow
+func (disk *VirtualDisk) grow() bool {
+	if disk.Growth <= 0 {
+		return false
+	}
+	disk.Capacity += disk.Growth
+	return true
+}
+
+// Release block index once its last record is deleted
+// The block receiving new records is emptied but kept, so is the last page of a table.
+func (disk *VirtualDisk) releaseBlock(index int) error {
+	block := &disk.Blocks[index]
+	for i := range block.Content {
+		block.Content[i] = 0
+	}
+	block.NumRecord = 0
+	block.Zone = ZoneMap{}
+	block.Versions = nil
+
+	if disk.Catalog == nil {
+		if index == disk.tail {
+			return nil
+		}
+	} else {
+		if !disk.Catalog.releasePage(index) {
+			return nil
+		}
+		if err := disk.saveCatalog(); err != nil {
+			return err
+		}
+	}
+
+	disk.markFree(index)
+	return nil
+}
+
+// Add block index to the free list
+func (disk *VirtualDisk) markFree(index int) {
+	for len(disk.freeMap) <= index/64 {
+		disk.freeMap = append(disk.freeMap, 0)
+	}
+	disk.freeMap[index/64] |= 1 << (index % 64)
+	disk.freeList = append(disk.freeList, index)
+}
+
+// Remove page from the table holding it, return false if it's the last page of the table
+func (catalog *Catalog) releasePage(page int) bool {
+	for _, table := range catalog.Tables {
+		for i, p := range table.Pages {
+			if p != page {
+				continue
+			}
+			if i == len(table.Pages)-1 {
+				return false
+			}
+			table.Pages = append(table.Pages[:i], table.Pages[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Compact Move the live records into the first blocks, and drop the blocks left empty
+// Records keep their order. Return the new address of every moved record keyed by its old address,
+// indexes on the disk have to be updated with it.
+func (disk *VirtualDisk) Compact() (map[*byte]*byte, error) {
+	return disk.compact(recordLayout)
+}
+
+// CompactBasics Move the live title.basics records into the first blocks, see Compact
+func (disk *VirtualDisk) CompactBasics() (map[*byte]*byte, error) {
+	return disk.compact(basicLayout)
+}
+
+func (disk *VirtualDisk) compact(l layout) (map[*byte]*byte, error) {
+	if disk.Catalog != nil {
+		return nil, errors.New("compacting a disk with a catalog isn't supported")
+	}
+
+	perBlock := disk.BlockSize / (l.size + 2) // Same block capacity as writeSlotIn
+	moved := map[*byte]*byte{}
+	luTable := map[*byte]RecordLocation{}
+	versions := make([][]Version, len(disk.Blocks))
+
+	// A record never moves past its own slot, so the slots it's copied into are already read
+	dst, slot := 0, 0
+	for i := range disk.Blocks {
+		block := &disk.Blocks[i]
+		for j := 0; j < int(block.NumRecord); j++ {
+			src := block.Content[j*l.size : (j+1)*l.size]
+			if !l.live(src) {
+				continue
+			}
+			if slot == perBlock {
+				dst++
+				slot = 0
+			}
+
+			target := disk.Blocks[dst].Content[slot*l.size : (slot+1)*l.size]
+			if dst != i || slot != j {
+				copy(target, src)
+				moved[&src[0]] = &target[0]
+			}
+			luTable[&target[0]] = RecordLocation{BlockIndex: dst, Index: slot}
+			if l.versioned {
+				versions[dst] = append(versions[dst], block.version(j))
+			}
+			slot++
+		}
+	}
+
+	// Clear the slots left behind, and rebuild the zone maps of the ratings
+	for i := 0; i <= dst; i++ {
+		block := &disk.Blocks[i]
+		block.NumRecord = uint16(perBlock)
+		if i == dst {
+			block.NumRecord = uint16(slot)
+			for j := slot * l.size; j < len(block.Content); j++ {
+				block.Content[j] = 0
+			}
+		}
+		block.Zone = ZoneMap{}
+		block.Versions = versions[i]
+		if !l.versioned {
+			continue
+		}
+		for j, record := range l.slots(*block) {
+			r := BytesToRecord(record)
+			block.Zone.add(&r, j == 0)
+		}
+	}
+
+	disk.Blocks = append([]Block(nil), disk.Blocks[:dst+1]...)
+	disk.BlockHeight = len(disk.Blocks)
+	disk.LuTable = luTable
+	disk.freeList = nil
+	disk.freeMap = nil
+	disk.tail = dst
+	return moved, nil
+}
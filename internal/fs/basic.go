@@ -0,0 +1,196 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/grailbio/base/tsv"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Fixed size schema of title.basics, text fields longer than their size are truncated
+// tconst: char(10) -> 10 bytes
+// titleType: char(12) -> 12 bytes
+// primaryTitle: char(60) -> 60 bytes
+// startYear: uint16 -> 2 bytes, 0 if unknown
+// runtimeMinutes: uint16 -> 2 bytes, 0 if unknown
+const (
+	TitleTypeSize    = 12
+	PrimaryTitleSize = 60
+	StartYearSize    = 2
+	RuntimeSize      = 2
+	BasicSize        = TconstSize + TitleTypeSize + PrimaryTitleSize + StartYearSize + RuntimeSize
+)
+
+// Basic Record of title.basics, stored on its own VirtualDisk or in a table of a catalog
+type Basic struct {
+	Tconst         string
+	TitleType      string
+	PrimaryTitle   string
+	StartYear      uint16
+	RuntimeMinutes uint16
+}
+
+// BasicToBytes pack basic into bytes
+func BasicToBytes(basic *Basic) []byte {
+	bin := make([]byte, BasicSize)
+	offset := 0
+
+	copy(bin[offset:offset+TconstSize], basic.Tconst)
+	offset += TconstSize
+	copy(bin[offset:offset+TitleTypeSize], truncate(basic.TitleType, TitleTypeSize))
+	offset += TitleTypeSize
+	copy(bin[offset:offset+PrimaryTitleSize], truncate(basic.PrimaryTitle, PrimaryTitleSize))
+	offset += PrimaryTitleSize
+
+	binary.BigEndian.PutUint16(bin[offset:], basic.StartYear)
+	offset += StartYearSize
+	binary.BigEndian.PutUint16(bin[offset:], basic.RuntimeMinutes)
+	return bin
+}
+
+// BytesToBasic unpack bytes into Basic, text fields are stripped of their padding
+func BytesToBasic(bin []byte) Basic {
+	offset := 0
+	text := func(size int) string {
+		s := strings.TrimRight(string(bin[offset:offset+size]), "\x00")
+		offset += size
+		return s
+	}
+
+	basic := Basic{
+		Tconst:       text(TconstSize),
+		TitleType:    text(TitleTypeSize),
+		PrimaryTitle: text(PrimaryTitleSize),
+	}
+	basic.StartYear = binary.BigEndian.Uint16(bin[offset:])
+	basic.RuntimeMinutes = binary.BigEndian.Uint16(bin[offset+StartYearSize:])
+	return basic
+}
+
+// WriteBasic Write basic into the virtual disk, with packing into bytes
+// Return the starting address of the record in the block, and error if any.
+func (disk *VirtualDisk) WriteBasic(basic *Basic) (*byte, error) {
+	if disk.Catalog != nil {
+		return nil, ErrTableRequired
+	}
+	if err := validateBasic(basic); err != nil {
+		return nil, err
+	}
+
+	addr, _, err := disk.writeSlot(BasicToBytes(basic))
+	return addr, err
+}
+
+// Basic validations
+func validateBasic(basic *Basic) error {
+	if basic.Tconst == "" {
+		return fmt.Errorf("%w: Tconst can't be empty", ErrInvalidRecord)
+	}
+	if len(basic.Tconst) > TconstSize {
+		return fmt.Errorf("%w: Tconst size is too long", ErrRecordTooLarge)
+	}
+	return nil
+}
+
+// AddrToBasic wrapper func for BytesToBasic
+// Return ErrRecordNotFound if no record is stored at addr
+func AddrToBasic(disk *VirtualDisk, addr *byte) (Basic, error) {
+	loc, exist := disk.LuTable[addr]
+	if !exist {
+		return Basic{}, fmt.Errorf("%w with addr: %v", ErrRecordNotFound, addr)
+	}
+
+	blockOffset := loc.Index * BasicSize
+	return BytesToBasic(disk.Blocks[loc.BlockIndex].Content[blockOffset : blockOffset+BasicSize]), nil
+}
+
+// DeleteBasic Remove the title.basics record at addr from the virtual disk, see DeleteRecord
+// The slot is zeroed as a tombstone (Tconst can't be empty for a live record).
+func (disk *VirtualDisk) DeleteBasic(addr *byte) error {
+	return disk.deleteSlot(basicLayout, addr)
+}
+
+// BlockToBasics wrapper func for BytesToBasic
+// Empty slots are skipped
+func BlockToBasics(block Block) ([]Basic, []*byte) {
+	var basics []Basic
+	var pointers []*byte
+
+	for i := 0; i < int(block.NumRecord); i++ {
+		if block.Content[i*BasicSize] == 0 {
+			// Tombstone, Tconst can't be empty
+			continue
+		}
+		basics = append(basics, BytesToBasic(block.Content[i*BasicSize:i*BasicSize+BasicSize]))
+		pointers = append(pointers, &block.Content[i*BasicSize])
+	}
+	return basics, pointers
+}
+
+// LoadBasics Load title.basics records from tsv file into VirtualDisk
+// Columns: tconst, titleType, primaryTitle, originalTitle, isAdult, startYear, endYear, runtimeMinutes, genres
+func (disk *VirtualDisk) LoadBasics(dir string) error {
+	return loadBasics(dir, disk.WriteBasic)
+}
+
+// Parse the title.basics tsv file and write every record with write
+func loadBasics(dir string, write func(basic *Basic) (*byte, error)) error {
+	fmt.Println("Loading basics from file....")
+	f, err := os.ReadFile(dir)
+	if err != nil {
+		return fmt.Errorf("error opening data file: %w", err)
+	}
+
+	r := tsv.NewReader(bytes.NewReader(f))
+	r.LazyQuotes = true // Titles may contain quotes
+	records, err := r.ReadAll()
+	if err != nil {
+		return fmt.Errorf("error reading data file: %w", err)
+	}
+	if len(records) == 0 {
+		return errors.New("data file is empty")
+	}
+
+	for _, rec := range records[1:] {
+		if len(rec) < 8 {
+			return fmt.Errorf("%w: %v", ErrInvalidRecord, rec)
+		}
+
+		basic := Basic{
+			Tconst:         rec[0],
+			TitleType:      rec[1],
+			PrimaryTitle:   rec[2],
+			StartYear:      parseOptional(rec[5]),
+			RuntimeMinutes: parseOptional(rec[7]),
+		}
+		if _, err = write(&basic); err != nil {
+			return fmt.Errorf("loading interrupted, consider increasing capacity of the virtual disk: %w", err)
+		}
+	}
+	fmt.Printf("Basics loaded into virtal disk, total: %v\n", len(records[1:]))
+	return nil
+}
+
+// Parse a number of title.basics, 0 for \N or invalid values
+func parseOptional(s string) uint16 {
+	value, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0
+	}
+	return uint16(value)
+}
+
+// Cut s to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && n < len(s) && s[n]&0xC0 == 0x80 {
+		n--
+	}
+	return s[:n]
+}
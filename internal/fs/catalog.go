@@ -0,0 +1,416 @@
+package fs
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrTableExists   = errors.New("table already exists")
+	ErrTableNotFound = errors.New("table not found")
+	ErrTableRequired = errors.New("disk has a catalog, records must be written into a table")
+)
+
+// Column of a table schema
+type Column struct {
+	Name string
+	Type string
+	Size int // Size in bytes
+}
+
+// Schema Record type of a table
+type Schema struct {
+	Name    string
+	Columns []Column
+}
+
+var (
+	RatingsSchema = Schema{
+		Name: "ratings",
+		Columns: []Column{
+			{Name: "tconst", Type: "char", Size: TconstSize},
+			{Name: "averageRating", Type: "decimal(3,1)", Size: AvgratingSize},
+			{Name: "numVotes", Type: "uint32", Size: NumvotesSize},
+		},
+	}
+	BasicsSchema = Schema{
+		Name: "basics",
+		Columns: []Column{
+			{Name: "tconst", Type: "char", Size: TconstSize},
+			{Name: "titleType", Type: "char", Size: TitleTypeSize},
+			{Name: "primaryTitle", Type: "char", Size: PrimaryTitleSize},
+			{Name: "startYear", Type: "uint16", Size: StartYearSize},
+			{Name: "runtimeMinutes", Type: "uint16", Size: RuntimeSize},
+		},
+	}
+)
+
+// RecordSize Get the size of a record of the schema
+func (schema Schema) RecordSize() int {
+	size := 0
+	for _, column := range schema.Columns {
+		size += column.Size
+	}
+	return size
+}
+
+// IndexInfo Index built on a table, the index itself is kept in memory
+type IndexInfo struct {
+	Name   string
+	Column string
+	Kind   string // e.g. bptree, hash, bitmap
+}
+
+// TableInfo Catalog entry of a table
+type TableInfo struct {
+	Name    string
+	Schema  Schema
+	Pages   []int // Blocks holding the records of the table, in insertion order
+	Indexes []IndexInfo
+}
+
+// Catalog Tables stored on a disk, persisted in a chain of catalog pages starting at block 0
+type Catalog struct {
+	Tables []*TableInfo
+	Pages  []int // Catalog pages, in chain order
+}
+
+// Extent Run of consecutive pages, the table pages are persisted as extents to keep the catalog small
+type Extent struct {
+	Start int
+	Count int
+}
+
+// Persisted form of a table, its pages are stored as extents
+type tableEntry struct {
+	Name    string
+	Schema  Schema
+	Extents []Extent
+	Indexes []IndexInfo
+}
+
+// Extents Get the pages of the table as runs of consecutive pages
+func (table *TableInfo) Extents() []Extent {
+	var extents []Extent
+	for _, page := range table.Pages {
+		last := len(extents) - 1
+		if last >= 0 && extents[last].Start+extents[last].Count == page {
+			extents[last].Count++
+			continue
+		}
+		extents = append(extents, Extent{Start: page, Count: 1})
+	}
+	return extents
+}
+
+// Catalog page layout
+// Next page: int32 - 4 bytes, -1 for the last page
+// Payload length: uint16 - 2 bytes
+// Payload: part of the JSON encoded tables, with their pages as extents
+const catalogHeaderSize = 4 + 2
+
+// CreateCatalog Reserve block 0 of an empty disk for the catalog, records are then written into tables
+func (disk *VirtualDisk) CreateCatalog() error {
+	if disk.Catalog != nil {
+		return errors.New("disk already has a catalog")
+	}
+	if len(disk.Blocks) != 1 || disk.Blocks[0].NumRecord > 0 {
+		return errors.New("a catalog can only be created on an empty disk")
+	}
+	if disk.BlockSize <= catalogHeaderSize {
+		return fmt.Errorf("block size %db can't fit a catalog page", disk.BlockSize)
+	}
+
+	disk.Catalog = &Catalog{Pages: []int{0}}
+	return disk.saveCatalog()
+}
+
+// CreateTable Add an empty table with schema to the catalog
+func (disk *VirtualDisk) CreateTable(name string, schema Schema) (*TableInfo, error) {
+	if disk.Catalog == nil {
+		return nil, errors.New("disk has no catalog")
+	}
+	if _, err := disk.Table(name); err == nil {
+		return nil, fmt.Errorf("%w: %v", ErrTableExists, name)
+	}
+	if schema.Name != RatingsSchema.Name && schema.Name != BasicsSchema.Name {
+		return nil, fmt.Errorf("unsupported schema %q", schema.Name)
+	}
+
+	table := &TableInfo{Name: name, Schema: schema}
+	disk.Catalog.Tables = append(disk.Catalog.Tables, table)
+	return table, disk.saveCatalog()
+}
+
+// Table Get the catalog entry of a table
+func (disk *VirtualDisk) Table(name string) (*TableInfo, error) {
+	if disk.Catalog != nil {
+		for _, table := range disk.Catalog.Tables {
+			if table.Name == name {
+				return table, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: %v", ErrTableNotFound, name)
+}
+
+// RegisterIndex Record an index built on a table in the catalog
+func (disk *VirtualDisk) RegisterIndex(name string, index IndexInfo) error {
+	table, err := disk.Table(name)
+	if err != nil {
+		return err
+	}
+	for _, existing := range table.Indexes {
+		if existing.Name == index.Name {
+			return fmt.Errorf("index %v already exists on %v", index.Name, name)
+		}
+	}
+	table.Indexes = append(table.Indexes, index)
+	return disk.saveCatalog()
+}
+
+// InsertRecord Write record into the last page of a ratings table
+func (disk *VirtualDisk) InsertRecord(name string, record *Record) (*byte, error) {
+	if err := validateRecord(record); err != nil {
+		return nil, err
+	}
+	addr, block, err := disk.insertSlot(name, RatingsSchema, RecordToBytes(record))
+	if err != nil {
+		return nil, err
+	}
+	block.Zone.add(record, block.NumRecord == 1)
+	disk.stamp(addr, Version{Begin: disk.tick()})
+	return addr, nil
+}
+
+// InsertBasic Write basic into the last page of a basics table
+func (disk *VirtualDisk) InsertBasic(name string, basic *Basic) (*byte, error) {
+	if err := validateBasic(basic); err != nil {
+		return nil, err
+	}
+	addr, _, err := disk.insertSlot(name, BasicsSchema, BasicToBytes(basic))
+	return addr, err
+}
+
+// LoadRecordsInto Load records from tsv file into a ratings table
+func (disk *VirtualDisk) LoadRecordsInto(name string, dir string) error {
+	return loadRecords(dir, func(record *Record) (*byte, error) {
+		return disk.InsertRecord(name, record)
+	})
+}
+
+// LoadBasicsInto Load title.basics records from tsv file into a basics table
+func (disk *VirtualDisk) LoadBasicsInto(name string, dir string) error {
+	return loadBasics(dir, func(basic *Basic) (*byte, error) {
+		return disk.InsertBasic(name, basic)
+	})
+}
+
+// ScanTable Linearly scan the pages of a ratings table for records matching predicate, see Scan
+func (disk *VirtualDisk) ScanTable(name string, predicate func(record Record) bool) (*Scanner, error) {
+	table, err := disk.Table(name)
+	if err != nil {
+		return nil, err
+	}
+	if table.Schema.Name != RatingsSchema.Name {
+		return nil, fmt.Errorf("table %v doesn't hold ratings", name)
+	}
+
+	scanner := disk.scan(predicate)
+	scanner.pages = table.Pages
+	if scanner.pages == nil {
+		scanner.pages = []int{}
+	}
+	return scanner, nil
+}
+
+// TableBlocks Get the blocks of a table, in insertion order
+func (disk *VirtualDisk) TableBlocks(name string) ([]Block, error) {
+	table, err := disk.Table(name)
+	if err != nil {
+		return nil, err
+	}
+	blocks := make([]Block, len(table.Pages))
+	for i, page := range table.Pages {
+		blocks[i] = disk.Blocks[page]
+	}
+	return blocks, nil
+}
+
+// LoadCatalog Read the catalog back from its pages, and rebuild the look-up table and zone maps of the table pages
+// The blocks that are neither catalog nor table pages are released.
+func (disk *VirtualDisk) LoadCatalog() error {
+	var payload []byte
+	var pages []int
+	used := make([]bool, len(disk.Blocks))
+	for page := 0; page >= 0; {
+		if page >= len(disk.Blocks) {
+			return fmt.Errorf("corrupted catalog: page %v is out of the disk", page)
+		}
+		if used[page] {
+			return fmt.Errorf("corrupted catalog: page %v is chained twice", page)
+		}
+		used[page] = true
+
+		content := disk.Blocks[page].Content
+		if len(content) < catalogHeaderSize {
+			return fmt.Errorf("corrupted catalog: page %v is too small", page)
+		}
+		length := int(binary.BigEndian.Uint16(content[4:]))
+		if catalogHeaderSize+length > len(content) {
+			return fmt.Errorf("corrupted catalog: payload of page %v is %vb, larger than the page", page, length)
+		}
+		payload = append(payload, content[catalogHeaderSize:catalogHeaderSize+length]...)
+		pages = append(pages, page)
+		page = int(int32(binary.BigEndian.Uint32(content)))
+	}
+
+	var entries []tableEntry
+	if err := json.Unmarshal(payload, &entries); err != nil {
+		return fmt.Errorf("corrupted catalog: %w", err)
+	}
+	catalog := &Catalog{Pages: pages}
+	for _, entry := range entries {
+		table := &TableInfo{Name: entry.Name, Schema: entry.Schema, Indexes: entry.Indexes}
+		for _, extent := range entry.Extents {
+			for page := extent.Start; page < extent.Start+extent.Count; page++ {
+				if page < 0 || page >= len(disk.Blocks) {
+					return fmt.Errorf("corrupted catalog: page %v of table %v is out of the disk", page, entry.Name)
+				}
+				if used[page] {
+					return fmt.Errorf("corrupted catalog: page %v of table %v is used twice", page, entry.Name)
+				}
+				used[page] = true
+				table.Pages = append(table.Pages, page)
+			}
+		}
+		catalog.Tables = append(catalog.Tables, table)
+	}
+
+	disk.Catalog = catalog
+	disk.BlockHeight = len(disk.Blocks)
+	disk.LuTable = map[*byte]RecordLocation{}
+	disk.freeList = nil
+	disk.freeMap = nil
+	for index, inUse := range used {
+		if !inUse {
+			disk.markFree(index)
+		}
+	}
+	for _, table := range catalog.Tables {
+		l := table.layout()
+		for _, page := range table.Pages {
+			block := &disk.Blocks[page]
+			first := true
+			for i := 0; i < int(block.NumRecord); i++ {
+				slot := block.Content[i*l.size : (i+1)*l.size]
+				if !l.live(slot) {
+					continue
+				}
+				disk.LuTable[&slot[0]] = RecordLocation{BlockIndex: page, Index: i}
+				if table.Schema.Name == RatingsSchema.Name {
+					// Zone maps are kept in memory only
+					record := BytesToRecord(slot)
+					block.Zone.add(&record, first)
+					first = false
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Slot layout of the records of the table
+func (table *TableInfo) layout() layout {
+	if table.Schema.Name == BasicsSchema.Name {
+		return basicLayout
+	}
+	return recordLayout
+}
+
+// Write slot into the last page of a table, adding a page when it's full
+func (disk *VirtualDisk) insertSlot(name string, schema Schema, bin []byte) (*byte, *Block, error) {
+	table, err := disk.Table(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if table.Schema.Name != schema.Name {
+		return nil, nil, fmt.Errorf("table %v doesn't hold %v", name, schema.Name)
+	}
+
+	if len(table.Pages) == 0 {
+		page, err := disk.newBlock()
+		if err != nil {
+			return nil, nil, err
+		}
+		table.Pages = append(table.Pages, page)
+		if err = disk.saveCatalog(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	last := table.Pages[len(table.Pages)-1]
+	addr, index, err := disk.writeSlotIn(last, bin)
+	if err != nil {
+		return nil, nil, err
+	}
+	if index != last {
+		table.Pages = append(table.Pages, index)
+		if err = disk.saveCatalog(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return addr, &disk.Blocks[index], nil
+}
+
+// Write the catalog into its pages, chaining new pages as it grows
+func (disk *VirtualDisk) saveCatalog() error {
+	entries := make([]tableEntry, len(disk.Catalog.Tables))
+	for i, table := range disk.Catalog.Tables {
+		entries[i] = tableEntry{Name: table.Name, Schema: table.Schema, Extents: table.Extents(), Indexes: table.Indexes}
+	}
+	payload, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	perPage := disk.BlockSize - catalogHeaderSize
+	needed := (len(payload) + perPage - 1) / perPage
+	if needed == 0 {
+		needed = 1
+	}
+	for len(disk.Catalog.Pages) < needed {
+		page, err := disk.newBlock()
+		if err != nil {
+			return err
+		}
+		disk.Catalog.Pages = append(disk.Catalog.Pages, page)
+	}
+
+	for i, page := range disk.Catalog.Pages {
+		content := disk.Blocks[page].Content
+		for j := range content {
+			content[j] = 0
+		}
+
+		next := int32(-1)
+		if i+1 < needed {
+			next = int32(disk.Catalog.Pages[i+1])
+		}
+		start := i * perPage
+		end := start + perPage
+		if start > len(payload) {
+			start = len(payload)
+		}
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		binary.BigEndian.PutUint32(content, uint32(next))
+		binary.BigEndian.PutUint16(content[4:], uint16(end-start))
+		copy(content[catalogHeaderSize:], payload[start:end])
+	}
+	return nil
+}
@@ -10,17 +10,34 @@ import (
 	"strconv"
 )
 
+var (
+	ErrDiskFull       = errors.New("not enough disk space to allocate a new block")
+	ErrRecordNotFound = errors.New("record can't be located")
+	ErrRecordTooLarge = errors.New("record is too large")
+	ErrInvalidRecord  = errors.New("invalid record")
+)
+
 type VirtualDisk struct {
 	Capacity    int // Capacity in bytes
+	Growth      int // Capacity in bytes added when the disk is full, 0 to return ErrDiskFull instead
 	BlockSize   int // Block size in bytes
 	BlockHeight int // Number of blocks preceding in the disk
 	Blocks      []Block
 	LuTable     map[*byte]RecordLocation // Look-up table - Key: Address of record, Value: Block Index
+	Catalog     *Catalog                 // Tables on the disk, nil for a disk holding a single stream of records
+
+	tail     int      // Block receiving the next record
+	freeList []int    // Released blocks, reused before allocating new ones
+	freeMap  []uint64 // Bit per block, set if the block is released
+	clock    uint64   // Timestamp of the latest write, see Now
+	ended    int      // Ended versions still stored, see EndedVersions
 }
 
 type Block struct {
 	NumRecord uint16 // 2 byte
 	Content   []byte
+	Zone      ZoneMap   // Min/max of the records in the block, kept in memory
+	Versions  []Version // Timestamps of the slots, kept in memory, see Version
 }
 
 type RecordLocation struct {
@@ -30,7 +47,8 @@ type RecordLocation struct {
 
 // NewVirtualDisk Create a storage struct with given capacity and block size
 // capacity in MB, block size in bytes
-func NewVirtualDisk(capacity int, blockSize int) VirtualDisk {
+// Return ErrRecordTooLarge if a block can't hold a single record, ErrDiskFull if the disk can't hold a single block
+func NewVirtualDisk(capacity int, blockSize int) (VirtualDisk, error) {
 	vd := VirtualDisk{
 		Capacity:    capacity * 1_000_000,
 		BlockSize:   blockSize,
@@ -38,20 +56,27 @@ func NewVirtualDisk(capacity int, blockSize int) VirtualDisk {
 		LuTable:     map[*byte]RecordLocation{},
 	}
 
+	if blockSize < RecordSize+2 {
+		return vd, fmt.Errorf("%w: block size %db can't fit a record", ErrRecordTooLarge, blockSize)
+	}
+
 	_, err := vd.newBlock()
 	if err != nil {
-		panic("Sth went wrong, can't allocate memory")
+		return vd, err
 	}
 
 	fmt.Printf("New virtual storage created with capacity: %db, block size: %db\n", vd.Capacity, vd.BlockSize)
-	return vd
+	return vd, nil
 }
 
-// newBlock Create a new block in virtual disk
+// newBlock Create a new block in virtual disk, reusing a released block if any
 // Return the index of the newly created Block and any error
 func (disk *VirtualDisk) newBlock() (int, error) {
-	if disk.BlockHeight >= disk.Capacity/disk.BlockSize {
-		return -1, errors.New("not enough disk space to allocate a new block")
+	if index, ok := disk.reuseBlock(); ok {
+		return index, nil
+	}
+	if disk.BlockHeight >= disk.Capacity/disk.BlockSize && !disk.grow() {
+		return -1, ErrDiskFull
 	}
 
 	block := Block{
@@ -65,71 +90,159 @@ func (disk *VirtualDisk) newBlock() (int, error) {
 
 // WriteRecord Write record into the virtual disk, with packing into bytes
 // Return the starting address of the record in the block, and error if any.
+// ErrDiskFull is returned when no more block can be allocated
 func (disk *VirtualDisk) WriteRecord(record *Record) (*byte, error) {
+	if disk.Catalog != nil {
+		return nil, ErrTableRequired
+	}
+	if err := validateRecord(record); err != nil {
+		return nil, err
+	}
+
+	addr, block, err := disk.writeSlot(RecordToBytes(record))
+	if err != nil {
+		return nil, err
+	}
+	block.Zone.add(record, block.NumRecord == 1)
+	disk.stamp(addr, Version{Begin: disk.tick()})
+	return addr, nil
+}
+
+// NextRecordSlot Get the block and the address of the slot the next WriteRecord writes into
+// The address is nil if the block doesn't exist yet, WriteRecord then creates it.
+func (disk *VirtualDisk) NextRecordSlot() (int, *byte) {
+	index := disk.tail
+	if int(disk.Blocks[index].NumRecord) >= disk.BlockSize/(RecordSize+2) { // Same block capacity as writeSlotIn
+		// The tail is full, newBlock takes the last released block or appends one
+		if len(disk.freeList) == 0 {
+			return len(disk.Blocks), nil
+		}
+		index = disk.freeList[len(disk.freeList)-1]
+	}
+	block := &disk.Blocks[index]
+	return index, &block.Content[int(block.NumRecord)*RecordSize]
+}
 
-	// Record validations
+// Record validations
+func validateRecord(record *Record) error {
 	if record.NumVotes == 0 {
-		panic("NumVotes can't be zero")
+		return fmt.Errorf("%w: NumVotes can't be zero", ErrInvalidRecord)
 	}
 
 	if len([]rune(record.Tconst)) > TconstSize {
-		panic("Tconst size is too long")
+		return fmt.Errorf("%w: Tconst size is too long", ErrRecordTooLarge)
 	}
 
-	if record.AverageRating > 3.4e+38 {
-		panic("AverageRating is too big")
+	// AverageRating is stored as uint16(AverageRating * 10), NaN fails the check as well
+	if !(record.AverageRating >= 0 && record.AverageRating <= 6553.5) {
+		return fmt.Errorf("%w: AverageRating %v is out of 0-6553.5", ErrInvalidRecord, record.AverageRating)
 	}
+	return nil
+}
+
+// writeSlot Copy bin into the next free slot of the tail block, taking a new block when it's full
+// Slots are len(bin) bytes, a disk holds a single record type. Return the address of the slot and its block.
+func (disk *VirtualDisk) writeSlot(bin []byte) (*byte, *Block, error) {
+	addr, index, err := disk.writeSlotIn(disk.tail, bin)
+	if err != nil {
+		return nil, nil, err
+	}
+	disk.tail = index
+	return addr, &disk.Blocks[index], nil
+}
 
-	index := disk.BlockHeight - 1
+// writeSlotIn Copy bin into the next free slot of block index, creating a new block when it's full
+// Return the address of the slot and the index of the block holding it
+func (disk *VirtualDisk) writeSlotIn(index int, bin []byte) (*byte, int, error) {
 	block := &disk.Blocks[index]
 
-	blockCapacity := disk.BlockSize / (RecordSize + 2) // 2 bytes for the block header
+	blockCapacity := disk.BlockSize / (len(bin) + 2) // 2 bytes for the block header
 
-	//Last block is full, create a new block
+	//Block is full, create a new block
 	if int(block.NumRecord) >= blockCapacity {
 		i, err := disk.newBlock()
 		if err != nil {
-			return nil, errors.New("fail to write record")
+			return nil, -1, err
 		}
 		index = i
 		block = &disk.Blocks[index]
 	}
 
-	recordB := RecordToBytes(record)
-
-	copy(block.Content[block.NumRecord*RecordSize:], recordB) // Copy record into block
-	recordAddr := &block.Content[block.NumRecord*RecordSize]
-	disk.LuTable[recordAddr] = RecordLocation{BlockIndex: index, Index: int(block.NumRecord)}
+	offset := int(block.NumRecord) * len(bin)
+	copy(block.Content[offset:], bin) // Copy record into block
+	addr := &block.Content[offset]
+	disk.LuTable[addr] = RecordLocation{BlockIndex: index, Index: int(block.NumRecord)}
 
 	block.NumRecord += 1
-	return recordAddr, nil
+	return addr, index, nil
+}
+
+// DeleteRecord Remove the record at addr from the virtual disk
+// The slot is zeroed as a tombstone (NumVotes can't be zero for a live record), so addresses of other records stay valid.
+// The block is released for reuse once its last record is deleted.
+func (disk *VirtualDisk) DeleteRecord(addr *byte) error {
+	return disk.deleteSlot(recordLayout, addr)
+}
+
+// Zero the slot at addr laid out by l, and release its block once it has no live slot left
+func (disk *VirtualDisk) deleteSlot(l layout, addr *byte) error {
+	loc, exist := disk.LuTable[addr]
+	if !exist {
+		return ErrRecordNotFound
+	}
+
+	blockOffset := loc.Index * l.size
+	block := &disk.Blocks[loc.BlockIndex]
+	if block.version(loc.Index).End != 0 {
+		disk.ended--
+	}
+	copy(block.Content[blockOffset:blockOffset+l.size], make([]byte, l.size))
+	delete(disk.LuTable, addr)
+
+	if len(l.slots(*block)) == 0 {
+		return disk.releaseBlock(loc.BlockIndex)
+	}
+	return nil
 }
 
 // LoadRecords Load records from tsv file into VirtualDisk
 // dir is the relative file path
-func (disk *VirtualDisk) LoadRecords(dir string) {
+func (disk *VirtualDisk) LoadRecords(dir string) error {
+	return loadRecords(dir, disk.WriteRecord)
+}
+
+// Parse the tsv file and write every record with write
+func loadRecords(dir string, write func(record *Record) (*byte, error)) error {
 	fmt.Println("Loading records from file....")
 	// open file
 	f, err := os.ReadFile(dir)
 	if err != nil {
-		panic("Error opening data file")
+		return fmt.Errorf("error opening data file: %w", err)
 	}
 
 	r := tsv.NewReader(bytes.NewReader(f))
 
 	records, err := r.ReadAll()
+	if err != nil {
+		return fmt.Errorf("error reading data file: %w", err)
+	}
+	if len(records) == 0 {
+		return errors.New("data file is empty")
+	}
 
 	for _, rec := range records[1:] {
+		if len(rec) < 3 {
+			return fmt.Errorf("%w: %v", ErrInvalidRecord, rec)
+		}
 
 		avgRating, err := strconv.ParseFloat(rec[1], 32)
 		if err != nil {
-			panic("avgRating can't fit into float32")
+			return fmt.Errorf("%w: avgRating %v can't fit into float32", ErrInvalidRecord, rec[1])
 		}
 
 		numVotes, err := strconv.ParseUint(rec[2], 10, 32)
 		if err != nil {
-			fmt.Printf("%v", rec[2])
-			panic("numVotes can't fit into int32")
+			return fmt.Errorf("%w: numVotes %v can't fit into int32", ErrInvalidRecord, rec[2])
 		}
 
 		record := Record{
@@ -138,17 +251,33 @@ func (disk *VirtualDisk) LoadRecords(dir string) {
 			NumVotes:      uint32(numVotes),
 		}
 
-		_, err = disk.WriteRecord(&record)
+		_, err = write(&record)
 		if err != nil {
-			panic("Loading interrupted, not enough disk storage! Consider increasing capacity of the virtual disk")
+			return fmt.Errorf("loading interrupted, consider increasing capacity of the virtual disk: %w", err)
 		}
 	}
 	fmt.Printf("Records loaded into virtal disk, total: %v\n", len(records[1:]))
+	return nil
+}
+
+// Number of buffer blocks used by Cluster to sort the records
+const clusterBufferBlocks = 64
+
+// Cluster Reorganise the records on disk sorted by NumVotes, so that records with close NumVotes share blocks
+// Records with the same NumVotes keep their order. All record addresses change, indexes on the disk have to be rebuilt.
+// Disks with a catalog aren't supported, see ExternalSort.
+func (disk *VirtualDisk) Cluster() error {
+	sorted, _, err := disk.ExternalSort(ByNumVotes, clusterBufferBlocks)
+	if err != nil {
+		return err
+	}
+	*disk = *sorted
+	return nil
 }
 
 func (disk *VirtualDisk) GetDiskStats() (maxBlocks int, usedBlocks int, diskSize int, usedPercent float32) {
 	maxBlocks = disk.Capacity / disk.BlockSize
-	usedBlocks = len(disk.Blocks)
+	usedBlocks = len(disk.Blocks) - disk.FreeBlocks()
 	diskSize = usedBlocks * disk.BlockSize
 	usedPercent = float32(diskSize) * 100 / float32(disk.Capacity)
 	return
@@ -1,9 +1,6 @@
 package fs
 
-import (
-	"encoding/binary"
-	"fmt"
-)
+import "encoding/binary"
 
 // Simple schema with fixed size fields
 // tconst: char(10) -> 10 bytes
@@ -20,6 +17,8 @@ type Record struct {
 	Tconst        string
 	AverageRating float32
 	NumVotes      uint32
+	Begin         uint64 // Timestamp of the write creating this version, see Version
+	End           uint64 // Timestamp of the write replacing or deleting this version, 0 while current
 }
 
 // RecordToBytes pack record into bytes
@@ -68,30 +67,13 @@ func BytesToRecord(bytes []byte) Record {
 
 // AddrToRecord wrapper func for BytesToRecord
 // addr is the starting addr of a record stored in a block
-func AddrToRecord(disk *VirtualDisk, addr *byte) Record {
-	loc, exist := disk.LuTable[addr]
-	if !exist {
-		errMsg := fmt.Sprintf("Record can't be located with addr: %v", addr)
-		panic(errMsg)
-	}
-
-	blockOffset := loc.Index * RecordSize
-	bin := disk.Blocks[loc.BlockIndex].Content[blockOffset : blockOffset+RecordSize]
-
-	return BytesToRecord(bin)
+// Return ErrRecordNotFound if no record is stored at addr, ErrRecordNotVisible if it's an ended version
+func AddrToRecord(disk *VirtualDisk, addr *byte) (Record, error) {
+	return AddrToRecordAt(disk, addr, Latest)
 }
 
 // BlockToRecords wrapper func for BytesToRecord
+// Deleted records and ended versions are skipped
 func BlockToRecords(block Block) ([]Record, []*byte) {
-	var records []Record
-	var pointers []*byte
-	var record Record
-
-	for i := 0; i < int(block.NumRecord); i++ {
-		record = BytesToRecord(block.Content[i*RecordSize : i*RecordSize+RecordSize])
-		records = append(records, record)
-		pointers = append(pointers, &block.Content[i*RecordSize])
-	}
-
-	return records, pointers
+	return BlockToRecordsAt(block, Latest)
 }
@@ -0,0 +1,123 @@
+package fs
+
+import "fmt"
+
+// ScanStats Block access accounting of a full table scan
+type ScanStats struct {
+	BlocksRead      int
+	BlocksSkipped   int // Blocks ruled out by their zone map, see ScanZones
+	RecordsExamined int
+	Matches         int
+}
+
+// Scanner Iterator over the records of a VirtualDisk matching a predicate, one block at a time
+//
+//	scanner := disk.Scan(predicate)
+//	for scanner.Next() {
+//		record := scanner.Record()
+//	}
+//	if err := scanner.Err(); err != nil {
+//		...
+//	}
+type Scanner struct {
+	Stats ScanStats
+
+	disk        *VirtualDisk
+	predicate   func(record Record) bool
+	blockFilter func(zone ZoneMap) bool
+	pages       []int  // Blocks to read, every block of the disk if nil
+	ts          uint64 // Timestamp of the reader, see ScanAt
+	block       int    // Index of the next block to read
+	records     []Record
+	pointers    []*byte
+	pos         int   // Index of the current record in records
+	err         error // Error ending the scan before its first record
+}
+
+// Scan Linearly scan all blocks of the disk for records matching predicate
+// A nil predicate matches every record. The blocks of a disk with a catalog hold the pages of several tables:
+// the scan then ends at once with ErrTableRequired, see ScanTable.
+func (disk *VirtualDisk) Scan(predicate func(record Record) bool) *Scanner {
+	scanner := disk.scan(predicate)
+	if disk.Catalog != nil {
+		scanner.err = fmt.Errorf("%w: scan a table with ScanTable", ErrTableRequired)
+	}
+	return scanner
+}
+
+// Scanner over every block of the disk, whether it has a catalog or not
+func (disk *VirtualDisk) scan(predicate func(record Record) bool) *Scanner {
+	return &Scanner{
+		disk:      disk,
+		predicate: predicate,
+		ts:        Latest,
+		pos:       -1,
+	}
+}
+
+// Err Get the error that ended the scan, nil if it read every block
+func (scanner *Scanner) Err() error {
+	return scanner.err
+}
+
+// Next Advance to the next matching record, return false when the scan is done
+func (scanner *Scanner) Next() bool {
+	if scanner.err != nil {
+		return false
+	}
+	for {
+		scanner.pos++
+
+		// Read the next block once the current one is exhausted
+		for scanner.pos >= len(scanner.records) {
+			if scanner.block >= scanner.numBlocks() {
+				return false
+			}
+			if scanner.disk.IsFree(scanner.blockIndex()) {
+				scanner.block++
+				continue
+			}
+			block := scanner.disk.Blocks[scanner.blockIndex()]
+			if scanner.blockFilter != nil && !scanner.blockFilter(block.Zone) {
+				scanner.block++
+				scanner.Stats.BlocksSkipped++
+				continue
+			}
+			scanner.records, scanner.pointers = BlockToRecordsAt(block, scanner.ts)
+			scanner.block++
+			scanner.pos = 0
+			scanner.Stats.BlocksRead++
+		}
+
+		scanner.Stats.RecordsExamined++
+		if scanner.predicate == nil || scanner.predicate(scanner.records[scanner.pos]) {
+			scanner.Stats.Matches++
+			return true
+		}
+	}
+}
+
+func (scanner *Scanner) numBlocks() int {
+	if scanner.pages != nil {
+		return len(scanner.pages)
+	}
+	return len(scanner.disk.Blocks)
+}
+
+// Index in the disk of the next block to read
+func (scanner *Scanner) blockIndex() int {
+	if scanner.pages != nil {
+		return scanner.pages[scanner.block]
+	}
+	return scanner.block
+}
+
+// Record Get the current record
+func (scanner *Scanner) Record() Record {
+	return scanner.records[scanner.pos]
+}
+
+// Addr Get the address of the current record
+func (scanner *Scanner) Addr() *byte {
+	return scanner.pointers[scanner.pos]
+}
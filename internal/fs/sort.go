@@ -0,0 +1,304 @@
+package fs
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SortStats I/O accounting of an external sort
+type SortStats struct {
+	Runs          int // Sorted runs produced by the first pass
+	Passes        int // Passes over the data, including the first
+	BlocksRead    int
+	BlocksWritten int
+}
+
+// ByTconst Order records by Tconst, for ExternalSort
+func ByTconst(a Record, b Record) bool {
+	return strings.TrimRight(a.Tconst, "\x00") < strings.TrimRight(b.Tconst, "\x00")
+}
+
+// ByAverageRating Order records by AverageRating, for ExternalSort
+func ByAverageRating(a Record, b Record) bool {
+	return a.AverageRating < b.AverageRating
+}
+
+// ByNumVotes Order records by NumVotes, for ExternalSort
+func ByNumVotes(a Record, b Record) bool {
+	return a.NumVotes < b.NumVotes
+}
+
+// Slot layout of a record type, so that the sort handles ratings and basics alike
+type layout struct {
+	size      int
+	live      func(slot []byte) bool                              // False for the tombstone of a deleted record
+	write     func(disk *VirtualDisk, slot []byte) (*byte, error) // Write the record into disk
+	versioned bool                                                // Slots are stamped with their version
+}
+
+var recordLayout = layout{
+	size: RecordSize,
+	live: func(slot []byte) bool {
+		return BytesToRecord(slot).NumVotes != 0
+	},
+	write: func(disk *VirtualDisk, slot []byte) (*byte, error) {
+		record := BytesToRecord(slot)
+		return disk.WriteRecord(&record)
+	},
+	versioned: true,
+}
+
+var basicLayout = layout{
+	size: BasicSize,
+	live: func(slot []byte) bool {
+		return slot[0] != 0
+	},
+	write: func(disk *VirtualDisk, slot []byte) (*byte, error) {
+		basic := BytesToBasic(slot)
+		return disk.WriteBasic(&basic)
+	},
+}
+
+// Slot of a record being sorted, with the timestamp of its version
+type sortSlot struct {
+	bytes []byte
+	begin uint64
+}
+
+// Get the live slots of a block
+func (l layout) slots(block Block) [][]byte {
+	var slots [][]byte
+	for i := 0; i < int(block.NumRecord); i++ {
+		slot := block.Content[i*l.size : (i+1)*l.size]
+		if l.live(slot) {
+			slots = append(slots, slot)
+		}
+	}
+	return slots
+}
+
+// ExternalSort Sort the records by less into a new VirtualDisk, holding at most bufferBlocks blocks in memory
+// The first pass sorts bufferBlocks blocks at a time into runs, every further pass merges bufferBlocks-1 runs at a time
+// into one output block. The last pass writes into the new disk. Records comparing equal keep their order.
+// Only the current version of the records is sorted, and keeps its timestamp. The ended versions are dropped,
+// vacuum the disk first if a reader may still see them. Disks with a catalog aren't supported.
+func (disk *VirtualDisk) ExternalSort(less func(a Record, b Record) bool, bufferBlocks int) (*VirtualDisk, SortStats, error) {
+	return disk.externalSort(recordLayout, func(a []byte, b []byte) bool {
+		return less(BytesToRecord(a), BytesToRecord(b))
+	}, bufferBlocks)
+}
+
+// ExternalSortBasics Sort the title.basics records of the disk by less, see ExternalSort
+func (disk *VirtualDisk) ExternalSortBasics(less func(a Basic, b Basic) bool, bufferBlocks int) (*VirtualDisk, SortStats, error) {
+	return disk.externalSort(basicLayout, func(a []byte, b []byte) bool {
+		return less(BytesToBasic(a), BytesToBasic(b))
+	}, bufferBlocks)
+}
+
+func (disk *VirtualDisk) externalSort(l layout, less func(a []byte, b []byte) bool, bufferBlocks int) (*VirtualDisk, SortStats, error) {
+	var stats SortStats
+	if disk.Catalog != nil {
+		// The pages of every table would be sorted together
+		return nil, stats, errors.New("sorting a disk with a catalog isn't supported")
+	}
+	if bufferBlocks < 3 {
+		return nil, stats, fmt.Errorf("external sort needs at least 3 buffer blocks, got %v", bufferBlocks)
+	}
+
+	sorted := &VirtualDisk{
+		Capacity:  disk.Capacity,
+		Growth:    disk.Growth,
+		BlockSize: disk.BlockSize,
+		LuTable:   map[*byte]RecordLocation{},
+	}
+	if _, err := sorted.newBlock(); err != nil {
+		return nil, stats, err
+	}
+
+	// Pass 0: sort bufferBlocks blocks at a time
+	final := len(disk.Blocks) <= bufferBlocks
+	var runs [][]Block
+	for start := 0; start < len(disk.Blocks); start += bufferBlocks {
+		end := start + bufferBlocks
+		if end > len(disk.Blocks) {
+			end = len(disk.Blocks)
+		}
+
+		var slots []sortSlot
+		for _, block := range disk.Blocks[start:end] {
+			slots = append(slots, l.currentSlots(block)...)
+			stats.BlocksRead++
+		}
+		sort.SliceStable(slots, func(i, j int) bool {
+			return less(slots[i].bytes, slots[j].bytes)
+		})
+
+		w := disk.newRunWriter(l, sorted, final)
+		for _, slot := range slots {
+			if err := w.write(slot); err != nil {
+				return nil, stats, err
+			}
+		}
+		runs = append(runs, w.blocks)
+		stats.BlocksWritten += len(w.blocks)
+	}
+	stats.Runs = len(runs)
+	stats.Passes = 1
+
+	// Merge passes
+	fanIn := bufferBlocks - 1 // One block is kept for the output
+	for len(runs) > 1 {
+		final = len(runs) <= fanIn
+		var merged [][]Block
+		for start := 0; start < len(runs); start += fanIn {
+			end := start + fanIn
+			if end > len(runs) {
+				end = len(runs)
+			}
+
+			w := disk.newRunWriter(l, sorted, final)
+			if err := mergeRuns(l, runs[start:end], less, w, &stats); err != nil {
+				return nil, stats, err
+			}
+			merged = append(merged, w.blocks)
+			stats.BlocksWritten += len(w.blocks)
+		}
+		runs = merged
+		stats.Passes++
+	}
+
+	if sorted.Blocks[0].NumRecord > 0 {
+		stats.BlocksWritten += len(sorted.Blocks)
+	}
+	// The writes into the new disk kept the timestamps of the versions, so does its clock
+	sorted.clock = disk.clock
+	return sorted, stats, nil
+}
+
+// K-way merge of sorted runs, reading one block of every run at a time
+func mergeRuns(l layout, runs [][]Block, less func(a []byte, b []byte) bool, w *runWriter, stats *SortStats) error {
+	h := &mergeHeap{less: less}
+	for i, run := range runs {
+		reader := &runReader{layout: l, blocks: run, run: i, stats: stats}
+		if reader.next() {
+			h.readers = append(h.readers, reader)
+		}
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		reader := h.readers[0]
+		if err := w.write(reader.slots[reader.pos]); err != nil {
+			return err
+		}
+		if reader.next() {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
+
+// Writer of a sorted run, as blocks in memory, or into the output disk on the final pass
+type runWriter struct {
+	layout    layout
+	disk      *VirtualDisk // Output disk, nil when writing a run
+	blockSize int
+	blocks    []Block
+}
+
+func (disk *VirtualDisk) newRunWriter(l layout, sorted *VirtualDisk, final bool) *runWriter {
+	w := &runWriter{layout: l, blockSize: disk.BlockSize}
+	if final {
+		w.disk = sorted
+	}
+	return w
+}
+
+func (w *runWriter) write(slot sortSlot) error {
+	if w.disk != nil {
+		addr, err := w.layout.write(w.disk, slot.bytes)
+		if err == nil && w.layout.versioned {
+			w.disk.stamp(addr, Version{Begin: slot.begin})
+		}
+		return err
+	}
+
+	blockCapacity := w.blockSize / (w.layout.size + 2) // Same block layout as writeSlot
+	last := len(w.blocks) - 1
+	if last < 0 || int(w.blocks[last].NumRecord) >= blockCapacity {
+		w.blocks = append(w.blocks, Block{Content: make([]byte, w.blockSize)})
+		last++
+	}
+
+	block := &w.blocks[last]
+	copy(block.Content[int(block.NumRecord)*w.layout.size:], slot.bytes)
+	block.Versions = append(block.Versions, Version{Begin: slot.begin})
+	block.NumRecord++
+	return nil
+}
+
+// Reader of a sorted run, one block at a time
+type runReader struct {
+	layout layout
+	blocks []Block
+	run    int // Index of the run, ties are broken by it to keep the sort stable
+	block  int // Index of the next block to read
+	slots  []sortSlot
+	pos    int
+	stats  *SortStats
+}
+
+// Advance to the next record of the run, return false when the run is exhausted
+func (r *runReader) next() bool {
+	r.pos++
+	for r.pos >= len(r.slots) {
+		if r.block >= len(r.blocks) {
+			return false
+		}
+		r.slots = r.layout.currentSlots(r.blocks[r.block])
+		r.block++
+		r.pos = 0
+		r.stats.BlocksRead++
+	}
+	return true
+}
+
+// Min-heap of the run readers on their current record
+type mergeHeap struct {
+	readers []*runReader
+	less    func(a []byte, b []byte) bool
+}
+
+func (h *mergeHeap) Len() int {
+	return len(h.readers)
+}
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.readers[i], h.readers[j]
+	if h.less(a.slots[a.pos].bytes, b.slots[b.pos].bytes) {
+		return true
+	}
+	if h.less(b.slots[b.pos].bytes, a.slots[a.pos].bytes) {
+		return false
+	}
+	return a.run < b.run
+}
+
+func (h *mergeHeap) Swap(i, j int) {
+	h.readers[i], h.readers[j] = h.readers[j], h.readers[i]
+}
+
+func (h *mergeHeap) Push(x any) {
+	h.readers = append(h.readers, x.(*runReader))
+}
+
+func (h *mergeHeap) Pop() any {
+	last := h.readers[len(h.readers)-1]
+	h.readers = h.readers[:len(h.readers)-1]
+	return last
+}
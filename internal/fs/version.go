@@ -0,0 +1,245 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Record versions
+// Every record written is a version stamped with the timestamp of its write. Updating a record writes a new version
+// in a new slot and ends the old one at the same timestamp, deleting it only ends it. A reader at timestamp ts sees
+// the versions with Begin <= ts < End, so the old versions stay readable until Vacuum drops them.
+// Timestamps are kept in memory next to the slots like the zone maps, blocks written without them are visible to
+// every reader. LoadCatalog can't tell the versions of a record apart, vacuum the disk before reloading it.
+
+var ErrRecordNotVisible = errors.New("record isn't visible at this timestamp")
+
+// Latest Timestamp reading the current version of every record
+const Latest uint64 = math.MaxUint64
+
+// Version Lifetime of the record stored in a slot
+type Version struct {
+	Begin uint64 // Timestamp of the write creating the version, 0 if written without versions
+	End   uint64 // Timestamp of the write replacing or deleting it, 0 while current
+}
+
+// Check whether the version is visible to a reader at ts
+func (v Version) visible(ts uint64) bool {
+	return v.Begin <= ts && (v.End == 0 || v.End > ts)
+}
+
+// Version of slot i of block
+func (block Block) version(i int) Version {
+	if i >= len(block.Versions) {
+		return Version{}
+	}
+	return block.Versions[i]
+}
+
+// Now Get the timestamp of the latest write, a reader at Now sees every write so far
+func (disk *VirtualDisk) Now() uint64 {
+	return disk.clock
+}
+
+// EndedVersions Get the number of ended versions not vacuumed yet
+// Indexes point to them as well as to the current versions, see UpdateRecord.
+func (disk *VirtualDisk) EndedVersions() int {
+	return disk.ended
+}
+
+// Advance the clock for a new write
+func (disk *VirtualDisk) tick() uint64 {
+	disk.clock++
+	return disk.clock
+}
+
+// Set the version of the slot at addr
+func (disk *VirtualDisk) stamp(addr *byte, version Version) {
+	loc := disk.LuTable[addr]
+	block := &disk.Blocks[loc.BlockIndex]
+	for len(block.Versions) <= loc.Index {
+		block.Versions = append(block.Versions, Version{})
+	}
+	block.Versions[loc.Index] = version
+}
+
+// UpdateRecord Write record as the new version of the record at addr, return the address of the new version
+// The old version stays at addr for the readers before the update, indexes have to point to both.
+func (disk *VirtualDisk) UpdateRecord(addr *byte, record *Record) (*byte, error) {
+	if disk.Catalog != nil {
+		return nil, ErrTableRequired
+	}
+	if err := disk.checkRating(addr); err != nil {
+		return nil, err
+	}
+	old, err := AddrToRecord(disk, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err = validateRecord(record); err != nil {
+		return nil, err
+	}
+
+	newAddr, block, err := disk.writeSlot(RecordToBytes(record))
+	if err != nil {
+		return nil, err
+	}
+	block.Zone.add(record, block.NumRecord == 1)
+
+	ts := disk.tick()
+	disk.stamp(addr, Version{Begin: old.Begin, End: ts})
+	disk.stamp(newAddr, Version{Begin: ts})
+	disk.ended++
+	return newAddr, nil
+}
+
+// ExpireRecord Delete the record at addr for the readers from now on, readers before keep seeing it
+func (disk *VirtualDisk) ExpireRecord(addr *byte) error {
+	if disk.Catalog != nil {
+		return ErrTableRequired
+	}
+	if err := disk.checkRating(addr); err != nil {
+		return err
+	}
+	old, err := AddrToRecord(disk, addr)
+	if err != nil {
+		return err
+	}
+	disk.stamp(addr, Version{Begin: old.Begin, End: disk.tick()})
+	disk.ended++
+	return nil
+}
+
+// Check that the slot at addr holds a rating
+// Only ratings are stamped when written, the slots of other record types have no version.
+func (disk *VirtualDisk) checkRating(addr *byte) error {
+	loc, exist := disk.LuTable[addr]
+	if !exist {
+		return fmt.Errorf("%w with addr: %v", ErrRecordNotFound, addr)
+	}
+	block := disk.Blocks[loc.BlockIndex]
+	offset := loc.Index * RecordSize
+	if offset+RecordSize > len(block.Content) || &block.Content[offset] != addr || block.version(loc.Index).Begin == 0 {
+		return fmt.Errorf("%w: addr %v doesn't hold a rating", ErrInvalidRecord, addr)
+	}
+	return nil
+}
+
+// Vacuum Delete the versions ended at or before horizon, no reader at horizon or later can see them
+// horizon is the timestamp of the oldest reader still running, Now if there is none.
+// Return the addresses of the deleted versions, indexes have to drop them.
+func (disk *VirtualDisk) Vacuum(horizon uint64) ([]*byte, error) {
+	type deadSlot struct {
+		layout layout
+		addr   *byte
+	}
+	var slots []deadSlot
+	collect := func(l layout, index int) {
+		block := &disk.Blocks[index]
+		for j := 0; j < int(block.NumRecord) && j < len(block.Versions); j++ {
+			end := block.Versions[j].End
+			if end == 0 || end > horizon {
+				continue
+			}
+			addr := &block.Content[j*l.size]
+			if _, exist := disk.LuTable[addr]; exist {
+				slots = append(slots, deadSlot{layout: l, addr: addr})
+			}
+		}
+	}
+
+	if disk.Catalog == nil {
+		// Only the ratings are versioned
+		for i := range disk.Blocks {
+			collect(recordLayout, i)
+		}
+	} else {
+		for _, table := range disk.Catalog.Tables {
+			for _, page := range table.Pages {
+				collect(table.layout(), page)
+			}
+		}
+	}
+
+	dead := make([]*byte, len(slots))
+	for i, slot := range slots {
+		if err := disk.deleteSlot(slot.layout, slot.addr); err != nil {
+			return nil, err
+		}
+		dead[i] = slot.addr
+	}
+	return dead, nil
+}
+
+// ReadVersion Read the version stored at addr, whether it's visible or not
+// Return ErrRecordNotFound if no record is stored at addr
+func ReadVersion(disk *VirtualDisk, addr *byte) (Record, error) {
+	loc, exist := disk.LuTable[addr]
+	if !exist {
+		return Record{}, fmt.Errorf("%w with addr: %v", ErrRecordNotFound, addr)
+	}
+
+	block := disk.Blocks[loc.BlockIndex]
+	blockOffset := loc.Index * RecordSize
+	record := BytesToRecord(block.Content[blockOffset : blockOffset+RecordSize])
+	version := block.version(loc.Index)
+	record.Begin, record.End = version.Begin, version.End
+	return record, nil
+}
+
+// AddrToRecordAt Read the record at addr as seen by a reader at ts
+// Return ErrRecordNotVisible if the version at addr was written after ts or ended before
+func AddrToRecordAt(disk *VirtualDisk, addr *byte, ts uint64) (Record, error) {
+	record, err := ReadVersion(disk, addr)
+	if err != nil {
+		return Record{}, err
+	}
+	if !(Version{Begin: record.Begin, End: record.End}).visible(ts) {
+		return Record{}, fmt.Errorf("%w: addr %v at %v", ErrRecordNotVisible, addr, ts)
+	}
+	return record, nil
+}
+
+// BlockToRecordsAt Get the records of block as seen by a reader at ts
+func BlockToRecordsAt(block Block, ts uint64) ([]Record, []*byte) {
+	var records []Record
+	var pointers []*byte
+
+	for i := 0; i < int(block.NumRecord); i++ {
+		version := block.version(i)
+		if !version.visible(ts) {
+			continue
+		}
+		record := BytesToRecord(block.Content[i*RecordSize : i*RecordSize+RecordSize])
+		if record.NumVotes == 0 {
+			// Tombstone of a deleted record
+			continue
+		}
+		record.Begin, record.End = version.Begin, version.End
+		records = append(records, record)
+		pointers = append(pointers, &block.Content[i*RecordSize])
+	}
+
+	return records, pointers
+}
+
+// ScanAt Linearly scan all blocks of the disk for records matching predicate, as seen by a reader at ts
+func (disk *VirtualDisk) ScanAt(ts uint64, predicate func(record Record) bool) *Scanner {
+	scanner := disk.Scan(predicate)
+	scanner.ts = ts
+	return scanner
+}
+
+// Get the live slots of a block holding a current version, ended versions aren't carried over by a sort
+func (l layout) currentSlots(block Block) []sortSlot {
+	var slots []sortSlot
+	for i := 0; i < int(block.NumRecord); i++ {
+		slot := block.Content[i*l.size : (i+1)*l.size]
+		version := block.version(i)
+		if l.live(slot) && version.End == 0 {
+			slots = append(slots, sortSlot{bytes: slot, begin: version.Begin})
+		}
+	}
+	return slots
+}
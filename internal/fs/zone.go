@@ -0,0 +1,35 @@
+package fs
+
+// ZoneMap Min/max of the columns of the records written to a block
+// Deleting a record doesn't shrink the zone map, it stays a valid bound of the live records
+type ZoneMap struct {
+	MinNumVotes uint32
+	MaxNumVotes uint32
+	MinRating   float32
+	MaxRating   float32
+}
+
+// Widen the zone map to include record, first is set for the first record of the block
+func (zone *ZoneMap) add(record *Record, first bool) {
+	if first || record.NumVotes < zone.MinNumVotes {
+		zone.MinNumVotes = record.NumVotes
+	}
+	if first || record.NumVotes > zone.MaxNumVotes {
+		zone.MaxNumVotes = record.NumVotes
+	}
+	if first || record.AverageRating < zone.MinRating {
+		zone.MinRating = record.AverageRating
+	}
+	if first || record.AverageRating > zone.MaxRating {
+		zone.MaxRating = record.AverageRating
+	}
+}
+
+// ScanZones Scan the blocks whose zone map passes blockFilter for records matching predicate
+// Blocks failing blockFilter are skipped without being read, see ScanStats.BlocksSkipped
+// A nil blockFilter reads every block, a nil predicate matches every record
+func (disk *VirtualDisk) ScanZones(blockFilter func(zone ZoneMap) bool, predicate func(record Record) bool) *Scanner {
+	scanner := disk.Scan(predicate)
+	scanner.blockFilter = blockFilter
+	return scanner
+}
@@ -0,0 +1,3 @@
+module hashidx
+
+go 1.19
@@ -0,0 +1,231 @@
+// Package hashidx contains an extendible hashing index for point lookups on Tconst
+package hashidx
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// Bucket page layout, one bucket per block
+// Local depth: uint8 - 1 byte
+// Number of entries: uint16 - 2 bytes
+// Overflow: ptr to overflow page - 8 bytes
+// Entries: tconst char(10) + record ptr - 18 bytes each
+const (
+	HeaderSize = 1 + 2 + 8
+	KeySize    = 10
+	PtrSize    = 8
+	EntrySize  = KeySize + PtrSize
+)
+
+// Max number of hash bits used by the directory, buckets that still overflow get overflow pages
+const maxDepth = 20
+
+var (
+	ErrKeyNotFound  = errors.New("key not found")
+	ErrDuplicateKey = errors.New("key already exists")
+)
+
+// HashIndex Extendible hashing index, mapping a tconst to the address of its record
+type HashIndex struct {
+	GlobalDepth     int       // Number of hash bits indexing the directory
+	Directory       []*Bucket // 2^GlobalDepth slots, buckets with a smaller local depth are shared by several slots
+	BucketSize      int       // Entries per bucket page
+	BucketsAccessed int       // Bucket pages read by the last Search, Insert or Delete
+	Splits          int       // Number of bucket splits so far
+
+	size int // Number of keys
+}
+
+// Bucket Page of entries whose hashes share the lowest LocalDepth bits
+type Bucket struct {
+	LocalDepth int
+	Keys       []string
+	Addrs      []*byte
+	Overflow   *Bucket // Chained page, once the bucket can't be split any further
+}
+
+// New Create an empty index with buckets sized to blockSize
+func New(blockSize int) (*HashIndex, error) {
+	bucketSize := (blockSize - HeaderSize) / EntrySize
+	if bucketSize < 1 {
+		return nil, fmt.Errorf("block size %db can't fit a bucket entry", blockSize)
+	}
+
+	return &HashIndex{
+		Directory:  []*Bucket{{}},
+		BucketSize: bucketSize,
+	}, nil
+}
+
+// Search Get the address of the record with tconst
+// Return ErrKeyNotFound if the index doesn't hold tconst
+func (index *HashIndex) Search(tconst string) (*byte, error) {
+	key := normalize(tconst)
+	index.BucketsAccessed = 0
+
+	for bucket := index.bucket(key); bucket != nil; bucket = bucket.Overflow {
+		index.BucketsAccessed++
+		if i := bucket.find(key); i >= 0 {
+			return bucket.Addrs[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %v", ErrKeyNotFound, key)
+}
+
+// Insert Add tconst pointing to addr, splitting the bucket and doubling the directory as needed
+// Return ErrDuplicateKey if tconst is already indexed
+func (index *HashIndex) Insert(tconst string, addr *byte) error {
+	key := normalize(tconst)
+	if _, err := index.Search(key); err == nil {
+		return fmt.Errorf("%w: %v", ErrDuplicateKey, key)
+	}
+
+	for {
+		bucket := index.bucket(key)
+		if len(bucket.Keys) < index.BucketSize {
+			bucket.Keys = append(bucket.Keys, key)
+			bucket.Addrs = append(bucket.Addrs, addr)
+			index.size++
+			return nil
+		}
+
+		if bucket.LocalDepth >= maxDepth {
+			index.insertOverflow(bucket, key, addr)
+			index.size++
+			return nil
+		}
+		index.split(bucket)
+	}
+}
+
+// Delete Remove tconst from the index
+// Empty buckets are kept, the directory never shrinks
+func (index *HashIndex) Delete(tconst string) error {
+	key := normalize(tconst)
+	index.BucketsAccessed = 0
+
+	for bucket := index.bucket(key); bucket != nil; bucket = bucket.Overflow {
+		index.BucketsAccessed++
+		if i := bucket.find(key); i >= 0 {
+			last := len(bucket.Keys) - 1
+			bucket.Keys[i], bucket.Addrs[i] = bucket.Keys[last], bucket.Addrs[last]
+			bucket.Keys = bucket.Keys[:last]
+			bucket.Addrs = bucket.Addrs[:last]
+			index.size--
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %v", ErrKeyNotFound, key)
+}
+
+// Len Get the number of indexed keys
+func (index *HashIndex) Len() int {
+	return index.size
+}
+
+// GetTotalBuckets Get the number of bucket pages, including overflow pages
+func (index *HashIndex) GetTotalBuckets() int {
+	total := 0
+	seen := map[*Bucket]bool{}
+	for _, bucket := range index.Directory {
+		if seen[bucket] {
+			continue
+		}
+		seen[bucket] = true
+		for ; bucket != nil; bucket = bucket.Overflow {
+			total++
+		}
+	}
+	return total
+}
+
+// LoadFactor Get the fraction of bucket entries in use
+func (index *HashIndex) LoadFactor() float64 {
+	buckets := index.GetTotalBuckets()
+	if buckets == 0 {
+		return 0
+	}
+	return float64(index.size) / float64(buckets*index.BucketSize)
+}
+
+// Split a full bucket on its next hash bit, doubling the directory first if the bucket is already at the global depth
+func (index *HashIndex) split(bucket *Bucket) {
+	if bucket.LocalDepth == index.GlobalDepth {
+		index.Directory = append(index.Directory, index.Directory...)
+		index.GlobalDepth++
+	}
+
+	bit := uint32(1) << bucket.LocalDepth
+	low := &Bucket{LocalDepth: bucket.LocalDepth + 1}
+	high := &Bucket{LocalDepth: bucket.LocalDepth + 1}
+	for i, key := range bucket.Keys {
+		target := low
+		if hash(key)&bit != 0 {
+			target = high
+		}
+		target.Keys = append(target.Keys, key)
+		target.Addrs = append(target.Addrs, bucket.Addrs[i])
+	}
+
+	// Repoint the directory slots of the old bucket
+	for i, slot := range index.Directory {
+		if slot != bucket {
+			continue
+		}
+		if uint32(i)&bit != 0 {
+			index.Directory[i] = high
+		} else {
+			index.Directory[i] = low
+		}
+	}
+	index.Splits++
+}
+
+// Append to the last page of the bucket chain, adding a page when it's full
+func (index *HashIndex) insertOverflow(bucket *Bucket, key string, addr *byte) {
+	for len(bucket.Keys) >= index.BucketSize {
+		if bucket.Overflow == nil {
+			bucket.Overflow = &Bucket{LocalDepth: bucket.LocalDepth}
+		}
+		bucket = bucket.Overflow
+	}
+	bucket.Keys = append(bucket.Keys, key)
+	bucket.Addrs = append(bucket.Addrs, addr)
+}
+
+// Get the primary bucket of key
+func (index *HashIndex) bucket(key string) *Bucket {
+	mask := uint32(1)<<index.GlobalDepth - 1
+	return index.Directory[hash(key)&mask]
+}
+
+// Get the position of key in the page, -1 if absent
+func (bucket *Bucket) find(key string) int {
+	for i, k := range bucket.Keys {
+		if k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// FNV-1a, with a final mix so that the low bits used by the directory depend on every byte of sequential tconsts
+func hash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// Strip the zero padding of a tconst read back from a block
+func normalize(tconst string) string {
+	return strings.TrimRight(tconst, "\x00")
+}
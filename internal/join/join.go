@@ -0,0 +1,290 @@
+// Package join contains join operators on tconst between a ratings VirtualDisk and a title.basics VirtualDisk
+package join
+
+import (
+	"fmt"
+	"internal/bptree"
+	"internal/fs"
+	"internal/hashidx"
+	"strconv"
+	"strings"
+)
+
+// Row Joined ratings and title.basics record
+type Row struct {
+	Rating fs.Record
+	Basic  fs.Basic
+}
+
+// Stats Block access accounting of a join
+type Stats struct {
+	OuterBlocks int // Blocks of ratings read
+	InnerBlocks int // Blocks of basics read
+	IndexNodes  int // Index nodes or bucket pages read, by IndexNestedLoop
+	SortBlocks  int // Blocks read and written by the external sorts, by SortMerge
+	Matches     int
+}
+
+// Total Get the number of block accesses of the join
+func (stats Stats) Total() int {
+	return stats.OuterBlocks + stats.InnerBlocks + stats.IndexNodes + stats.SortBlocks
+}
+
+// BlockNestedLoop Join by holding bufferBlocks-2 blocks of ratings in memory at a time, and scanning basics once per chunk
+// One buffer block is kept for basics and one for the output
+func BlockNestedLoop(ratings *fs.VirtualDisk, basics *fs.VirtualDisk, bufferBlocks int) ([]Row, Stats, error) {
+	var rows []Row
+	var stats Stats
+	chunkSize := bufferBlocks - 2
+	if chunkSize < 1 {
+		return nil, stats, fmt.Errorf("block nested-loop join needs at least 3 buffer blocks, got %v", bufferBlocks)
+	}
+
+	for start := 0; start < len(ratings.Blocks); start += chunkSize {
+		end := start + chunkSize
+		if end > len(ratings.Blocks) {
+			end = len(ratings.Blocks)
+		}
+
+		// Hash the chunk on tconst, so that matching a basics record doesn't compare it with every rating
+		chunk := map[string][]fs.Record{}
+		for _, block := range ratings.Blocks[start:end] {
+			records, _ := fs.BlockToRecords(block)
+			for _, record := range records {
+				key := tconst(record.Tconst)
+				chunk[key] = append(chunk[key], record)
+			}
+			stats.OuterBlocks++
+		}
+
+		for _, block := range basics.Blocks {
+			records, _ := fs.BlockToBasics(block)
+			for _, basic := range records {
+				for _, rating := range chunk[basic.Tconst] {
+					rows = append(rows, Row{Rating: rating, Basic: basic})
+				}
+			}
+			stats.InnerBlocks++
+		}
+	}
+
+	stats.Matches = len(rows)
+	return rows, stats, nil
+}
+
+// Index Lookup of basics records by tconst, for IndexNestedLoop
+type Index interface {
+	// Lookup Get the address of the basics record with tconst, nil if absent, and the number of index pages read
+	Lookup(tconst string) (*byte, int)
+}
+
+type hashIndex struct {
+	index *hashidx.HashIndex
+}
+
+// HashIndex Use a hash index on the tconst of basics
+func HashIndex(index *hashidx.HashIndex) Index {
+	return hashIndex{index: index}
+}
+
+func (h hashIndex) Lookup(tconst string) (*byte, int) {
+	addr, err := h.index.Search(tconst)
+	if err != nil {
+		return nil, h.index.BucketsAccessed
+	}
+	return addr, h.index.BucketsAccessed
+}
+
+type treeIndex struct {
+	tree *bptree.BPTree
+}
+
+// TreeIndex Use a B+ tree keyed by TconstKey on basics
+func TreeIndex(tree *bptree.BPTree) Index {
+	return treeIndex{tree: tree}
+}
+
+func (t treeIndex) Lookup(tconst string) (*byte, int) {
+	key, err := TconstKey(tconst)
+	if err != nil {
+		return nil, 0
+	}
+	addrs := t.tree.Search(key, false)
+	if len(addrs) == 0 {
+		return nil, t.tree.NodesAccessed
+	}
+	return addrs[0], t.tree.NodesAccessed
+}
+
+// BuildHashIndex Build a hash index on the tconst of basics
+func BuildHashIndex(basics *fs.VirtualDisk) (*hashidx.HashIndex, error) {
+	index, err := hashidx.New(basics.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range basics.Blocks {
+		records, pointers := fs.BlockToBasics(block)
+		for i, basic := range records {
+			if err := index.Insert(basic.Tconst, pointers[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return index, nil
+}
+
+// BuildTreeIndex Build a unique B+ tree of order on the TconstKey of basics, with more options if any
+func BuildTreeIndex(basics *fs.VirtualDisk, order int, opts ...bptree.Option) (*bptree.BPTree, error) {
+	tree := bptree.New(order, append([]bptree.Option{bptree.WithUnique()}, opts...)...)
+	for _, block := range basics.Blocks {
+		records, pointers := fs.BlockToBasics(block)
+		for i, basic := range records {
+			key, err := TconstKey(basic.Tconst)
+			if err != nil {
+				return nil, err
+			}
+			if err := tree.Insert(key, pointers[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return tree, nil
+}
+
+// IndexNestedLoop Join by scanning ratings once and looking up every record in the index on basics
+// Every match reads its basics block, there's no buffer pool to keep it
+func IndexNestedLoop(ratings *fs.VirtualDisk, basics *fs.VirtualDisk, index Index) ([]Row, Stats, error) {
+	var rows []Row
+	var stats Stats
+
+	for _, block := range ratings.Blocks {
+		records, _ := fs.BlockToRecords(block)
+		stats.OuterBlocks++
+
+		for _, rating := range records {
+			addr, pages := index.Lookup(tconst(rating.Tconst))
+			stats.IndexNodes += pages
+			if addr == nil {
+				continue
+			}
+
+			basic, err := fs.AddrToBasic(basics, addr)
+			if err != nil {
+				return nil, stats, err
+			}
+			stats.InnerBlocks++
+			rows = append(rows, Row{Rating: rating, Basic: basic})
+		}
+	}
+
+	stats.Matches = len(rows)
+	return rows, stats, nil
+}
+
+// SortMerge Sort both disks on tconst with bufferBlocks buffer blocks, then merge them in a single pass
+// The basics records sharing a tconst are assumed to fit in memory
+func SortMerge(ratings *fs.VirtualDisk, basics *fs.VirtualDisk, bufferBlocks int) ([]Row, Stats, error) {
+	var rows []Row
+	var stats Stats
+
+	sortedRatings, ratingStats, err := ratings.ExternalSort(fs.ByTconst, bufferBlocks)
+	if err != nil {
+		return nil, stats, err
+	}
+	sortedBasics, basicStats, err := basics.ExternalSortBasics(func(a fs.Basic, b fs.Basic) bool {
+		return a.Tconst < b.Tconst
+	}, bufferBlocks)
+	if err != nil {
+		return nil, stats, err
+	}
+	stats.SortBlocks = ratingStats.BlocksRead + ratingStats.BlocksWritten + basicStats.BlocksRead + basicStats.BlocksWritten
+
+	left := &cursor{disk: sortedRatings, blocksRead: &stats.OuterBlocks}
+	right := &cursor{disk: sortedBasics, blocksRead: &stats.InnerBlocks, basics: true}
+	left.next()
+	right.next()
+
+	for left.valid && right.valid {
+		leftKey, rightKey := tconst(left.record.Tconst), right.basic.Tconst
+		switch {
+		case leftKey < rightKey:
+			left.next()
+		case leftKey > rightKey:
+			right.next()
+		default:
+			var group []fs.Basic
+			for right.valid && right.basic.Tconst == leftKey {
+				group = append(group, right.basic)
+				right.next()
+			}
+			for left.valid && tconst(left.record.Tconst) == leftKey {
+				for _, basic := range group {
+					rows = append(rows, Row{Rating: left.record, Basic: basic})
+				}
+				left.next()
+			}
+		}
+	}
+
+	stats.Matches = len(rows)
+	return rows, stats, nil
+}
+
+// Sequential reader of a sorted disk, one block at a time
+type cursor struct {
+	disk       *fs.VirtualDisk
+	basics     bool // The disk holds title.basics records
+	blocksRead *int
+
+	block        int // Index of the next block to read
+	records      []fs.Record
+	basicRecords []fs.Basic
+	pos          int
+
+	valid  bool
+	record fs.Record
+	basic  fs.Basic
+}
+
+func (c *cursor) next() {
+	c.pos++
+	for c.pos >= c.size() {
+		if c.block >= len(c.disk.Blocks) {
+			c.valid = false
+			return
+		}
+		if c.basics {
+			c.basicRecords, _ = fs.BlockToBasics(c.disk.Blocks[c.block])
+		} else {
+			c.records, _ = fs.BlockToRecords(c.disk.Blocks[c.block])
+		}
+		c.block++
+		c.pos = 0
+		*c.blocksRead++
+	}
+
+	c.valid = true
+	if c.basics {
+		c.basic = c.basicRecords[c.pos]
+	} else {
+		c.record = c.records[c.pos]
+	}
+}
+
+func (c *cursor) size() int {
+	if c.basics {
+		return len(c.basicRecords)
+	}
+	return len(c.records)
+}
+
+// TconstKey Numeric part of a tconst, e.g. 1 for tt0000001, to key a BPTree on tconst
+func TconstKey(tconst string) (uint32, error) {
+	key, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimRight(tconst, "\x00"), "tt"), 10, 32)
+	return uint32(key), err
+}
+
+// Strip the zero padding of a tconst read back from a block
+func tconst(s string) string {
+	return strings.TrimRight(s, "\x00")
+}
@@ -0,0 +1,128 @@
+package query
+
+import (
+	"errors"
+	"internal/fs"
+	"math"
+	"sort"
+)
+
+// Aggregates Result of aggregating the values of a column
+type Aggregates struct {
+	Count  int
+	Sum    float64
+	Avg    float64
+	Min    float64
+	Max    float64
+	Stddev float64 // Population standard deviation
+
+	values []float64 // Sorted values, for percentiles
+}
+
+// Group Aggregates of the records in a rating bucket [Low, High)
+type Group struct {
+	Low   float64
+	High  float64
+	Value float64 // Aggregate selected by the statement, set by Execute
+	Aggregates
+}
+
+// Aggregate Compute the aggregates of column over records
+func Aggregate(records []fs.Record, column string) Aggregates {
+	values := make([]float64, len(records))
+	for i, record := range records {
+		values[i] = columnValue(record, column)
+	}
+	return aggregateValues(values)
+}
+
+// AggregateAddrs Compute the aggregates of column over the records at addrs, e.g. the result of SearchRange
+// Ended versions are skipped.
+func AggregateAddrs(disk *fs.VirtualDisk, addrs []*byte, column string) (Aggregates, error) {
+	values := make([]float64, 0, len(addrs))
+	for _, addr := range addrs {
+		record, err := fs.AddrToRecord(disk, addr)
+		if errors.Is(err, fs.ErrRecordNotVisible) {
+			continue
+		}
+		if err != nil {
+			return Aggregates{}, err
+		}
+		values = append(values, columnValue(record, column))
+	}
+	return aggregateValues(values), nil
+}
+
+// AggregateScan Compute the aggregates of column over the remaining records of a scan
+func AggregateScan(scanner *fs.Scanner, column string) Aggregates {
+	var values []float64
+	for scanner.Next() {
+		values = append(values, columnValue(scanner.Record(), column))
+	}
+	return aggregateValues(values)
+}
+
+// GroupByRating Compute the aggregates of column for every averageRating bucket of width, e.g. 1 for 5.0-5.9
+// Only non-empty buckets are returned, in ascending order
+func GroupByRating(records []fs.Record, column string, width float64) []Group {
+	buckets := map[int][]fs.Record{}
+	for _, record := range records {
+		bucket := int(math.Floor(columnValue(record, ColumnAverageRating)/width + 1e-9))
+		buckets[bucket] = append(buckets[bucket], record)
+	}
+
+	var groups []Group
+	for bucket, members := range buckets {
+		groups = append(groups, Group{
+			Low:        float64(bucket) * width,
+			High:       float64(bucket+1) * width,
+			Aggregates: Aggregate(members, column),
+		})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Low < groups[j].Low
+	})
+	return groups
+}
+
+// Percentile Get the p-th percentile (0-100) of the values, by linear interpolation between closest ranks
+func (agg *Aggregates) Percentile(p float64) float64 {
+	if len(agg.values) == 0 {
+		return 0
+	}
+
+	rank := p / 100 * float64(len(agg.values)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	if lower < 0 {
+		return agg.values[0]
+	}
+	if upper >= len(agg.values) {
+		return agg.values[len(agg.values)-1]
+	}
+	return agg.values[lower] + (rank-float64(lower))*(agg.values[upper]-agg.values[lower])
+}
+
+func aggregateValues(values []float64) Aggregates {
+	agg := Aggregates{Count: len(values)}
+	if len(values) == 0 {
+		return agg
+	}
+
+	sort.Float64s(values)
+	agg.values = values
+	agg.Min = values[0]
+	agg.Max = values[len(values)-1]
+
+	for _, value := range values {
+		agg.Sum += value
+	}
+	agg.Avg = agg.Sum / float64(len(values))
+
+	var variance float64
+	for _, value := range values {
+		variance += (value - agg.Avg) * (value - agg.Avg)
+	}
+	agg.Stddev = math.Sqrt(variance / float64(len(values)))
+	return agg
+}
@@ -0,0 +1,86 @@
+package query
+
+import (
+	"sort"
+)
+
+// Histogram Equi-depth histogram over the values of a column
+// Every bucket holds roughly the same number of values, values are assumed to be integers spread uniformly within a bucket
+type Histogram struct {
+	Buckets []Bucket
+	Total   int // Number of values
+}
+
+type Bucket struct {
+	Low      float64 // Smallest value in the bucket
+	High     float64 // Largest value in the bucket
+	Count    int     // Number of values in the bucket
+	Distinct int     // Number of distinct values in the bucket
+}
+
+// NewHistogram Build a histogram with up to numBuckets buckets
+func NewHistogram(values []float64, numBuckets int) *Histogram {
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	hist := &Histogram{Total: len(sorted)}
+	if len(sorted) == 0 || numBuckets <= 0 {
+		return hist
+	}
+
+	depth := (len(sorted) + numBuckets - 1) / numBuckets
+	for start := 0; start < len(sorted); {
+		end := start + depth
+		if end > len(sorted) {
+			end = len(sorted)
+		}
+		// Keep equal values in the same bucket
+		for end < len(sorted) && sorted[end] == sorted[end-1] {
+			end++
+		}
+
+		bucket := Bucket{Low: sorted[start], High: sorted[end-1], Count: end - start}
+		for i := start; i < end; i++ {
+			if i == start || sorted[i] != sorted[i-1] {
+				bucket.Distinct++
+			}
+		}
+		hist.Buckets = append(hist.Buckets, bucket)
+		start = end
+	}
+	return hist
+}
+
+// Estimate the number of values, and distinct values, in [from, to]
+func (hist *Histogram) Estimate(from float64, to float64) (count float64, distinct float64) {
+	for _, bucket := range hist.Buckets {
+		if bucket.High < from || bucket.Low > to {
+			continue
+		}
+
+		fraction := 1.0
+		if bucket.High > bucket.Low {
+			low, high := bucket.Low, bucket.High
+			if from > low {
+				low = from
+			}
+			if to < high {
+				high = to
+			}
+			fraction = (high - low + 1) / (bucket.High - bucket.Low + 1)
+		}
+		count += fraction * float64(bucket.Count)
+		distinct += fraction * float64(bucket.Distinct)
+	}
+	return
+}
+
+// Selectivity Estimated fraction of values in [from, to]
+func (hist *Histogram) Selectivity(from float64, to float64) float64 {
+	if hist.Total == 0 {
+		return 0
+	}
+	count, _ := hist.Estimate(from, to)
+	return count / float64(hist.Total)
+}
@@ -0,0 +1,302 @@
+// Package query contains a small SQL-like query language over an indexed VirtualDisk table
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Supported statements:
+// SELECT * FROM ratings [WHERE <predicate> [AND|OR <predicate>...]]
+// SELECT <aggregate> FROM ratings [WHERE ...] [GROUP BY averageRating]
+// DELETE [FROM ratings] WHERE numVotes <predicate>
+//
+// Aggregates: COUNT(*) | COUNT/SUM/AVG/MIN/MAX/STDDEV(<column>) | PERCENTILE(<column>, p)
+// GROUP BY averageRating groups the records into rating buckets of 1, e.g. 5.0-5.9
+//
+// Predicates: <column> = x | <column> BETWEEN a AND b | <column> >= x | <column> <= x
+// Predicates are joined either all by AND or all by OR
+
+const (
+	ColumnTconst        = "tconst"
+	ColumnAverageRating = "averageRating"
+	ColumnNumVotes      = "numVotes"
+)
+
+type StatementKind int
+
+const (
+	Select StatementKind = iota
+	Delete
+)
+
+type Statement struct {
+	Kind       StatementKind
+	Table      string
+	Aggregate  string  // COUNT, SUM, AVG, MIN, MAX, STDDEV or PERCENTILE, empty for SELECT *
+	Column     string  // Column of the aggregate
+	Percentile float64 // p of PERCENTILE
+	Where      []Predicate
+	Or         bool // Predicates of Where are joined by OR instead of AND
+	GroupBy    bool // Group by averageRating bucket
+}
+
+var aggregates = []string{"COUNT", "SUM", "AVG", "MIN", "MAX", "STDDEV", "PERCENTILE"}
+
+// Predicate Inclusive range condition on a numeric column
+type Predicate struct {
+	Column string
+	From   float64
+	To     float64
+}
+
+var ErrSyntax = errors.New("syntax error")
+
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+// Parse a statement
+func Parse(sql string) (*Statement, error) {
+	p := &parser{tokens: tokenize(sql)}
+	stmt := &Statement{}
+
+	switch strings.ToUpper(p.next()) {
+	case "SELECT":
+		stmt.Kind = Select
+		if err := p.parseProjection(stmt); err != nil {
+			return nil, err
+		}
+		if err := p.expect("FROM"); err != nil {
+			return nil, err
+		}
+		stmt.Table = p.next()
+	case "DELETE":
+		stmt.Kind = Delete
+		if strings.EqualFold(p.peek(), "FROM") {
+			p.next()
+			stmt.Table = p.next()
+		}
+	default:
+		return nil, fmt.Errorf("%w: expected SELECT or DELETE", ErrSyntax)
+	}
+
+	if strings.EqualFold(p.peek(), "WHERE") {
+		p.next()
+		for {
+			pred, err := p.parsePredicate()
+			if err != nil {
+				return nil, err
+			}
+			stmt.Where = append(stmt.Where, pred)
+
+			join := strings.ToUpper(p.peek())
+			if join != "AND" && join != "OR" {
+				break
+			}
+			if len(stmt.Where) > 1 && (join == "OR") != stmt.Or {
+				return nil, fmt.Errorf("%w: mixing AND and OR is not supported", ErrSyntax)
+			}
+			stmt.Or = join == "OR"
+			p.next()
+		}
+	}
+
+	if stmt.Kind == Select && strings.EqualFold(p.peek(), "GROUP") {
+		p.next()
+		if err := p.expect("BY"); err != nil {
+			return nil, err
+		}
+		column, err := columnName(p.next())
+		if err != nil {
+			return nil, err
+		}
+		if column != ColumnAverageRating {
+			return nil, fmt.Errorf("%w: only GROUP BY %v is supported", ErrSyntax, ColumnAverageRating)
+		}
+		if stmt.Aggregate == "" {
+			return nil, fmt.Errorf("%w: GROUP BY requires an aggregate", ErrSyntax)
+		}
+		stmt.GroupBy = true
+	}
+
+	if p.peek() == ";" {
+		p.next()
+	}
+	if p.peek() != "" {
+		return nil, fmt.Errorf("%w: unexpected %q", ErrSyntax, p.peek())
+	}
+	if stmt.Kind == Delete && len(stmt.Where) == 0 {
+		return nil, fmt.Errorf("%w: DELETE requires a WHERE clause", ErrSyntax)
+	}
+	return stmt, nil
+}
+
+func (p *parser) parseProjection(stmt *Statement) error {
+	token := p.next()
+	if token == "*" {
+		return nil
+	}
+
+	stmt.Aggregate = strings.ToUpper(token)
+	supported := false
+	for _, aggregate := range aggregates {
+		if stmt.Aggregate == aggregate {
+			supported = true
+		}
+	}
+	if !supported {
+		return fmt.Errorf("%w: unsupported projection %q", ErrSyntax, token)
+	}
+	if err := p.expect("("); err != nil {
+		return err
+	}
+
+	column := p.next()
+	if column == "*" {
+		if stmt.Aggregate != "COUNT" {
+			return fmt.Errorf("%w: %v(*) is not supported", ErrSyntax, stmt.Aggregate)
+		}
+	} else {
+		name, err := columnName(column)
+		if err != nil {
+			return err
+		}
+		stmt.Column = name
+	}
+
+	if stmt.Aggregate == "PERCENTILE" {
+		if err := p.expect(","); err != nil {
+			return err
+		}
+		percentile, err := p.number()
+		if err != nil {
+			return err
+		}
+		if percentile > 100 {
+			return fmt.Errorf("%w: percentile must be between 0 and 100", ErrSyntax)
+		}
+		stmt.Percentile = percentile
+	}
+	return p.expect(")")
+}
+
+func (p *parser) parsePredicate() (Predicate, error) {
+	var pred Predicate
+	var err error
+
+	pred.Column, err = columnName(p.next())
+	if err != nil {
+		return pred, err
+	}
+
+	op := strings.ToUpper(p.next())
+	switch op {
+	case "=":
+		pred.From, err = p.number()
+		pred.To = pred.From
+	case ">=":
+		pred.From, err = p.number()
+		pred.To = maxValue(pred.Column)
+	case "<=":
+		pred.To, err = p.number()
+	case "BETWEEN":
+		if pred.From, err = p.number(); err != nil {
+			return pred, err
+		}
+		if err = p.expect("AND"); err != nil {
+			return pred, err
+		}
+		pred.To, err = p.number()
+	default:
+		return pred, fmt.Errorf("%w: unsupported operator %q", ErrSyntax, op)
+	}
+	return pred, err
+}
+
+func (p *parser) number() (float64, error) {
+	token := p.next()
+	value, err := strconv.ParseFloat(token, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("%w: expected a number, got %q", ErrSyntax, token)
+	}
+	return value, nil
+}
+
+func (p *parser) expect(token string) error {
+	if !strings.EqualFold(p.next(), token) {
+		return fmt.Errorf("%w: expected %v", ErrSyntax, token)
+	}
+	return nil
+}
+
+func (p *parser) next() string {
+	token := p.peek()
+	if p.pos < len(p.tokens) {
+		p.pos++
+	}
+	return token
+}
+
+func (p *parser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+// Split the statement into words and symbols
+func tokenize(sql string) []string {
+	var tokens []string
+	var word strings.Builder
+
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, word.String())
+			word.Reset()
+		}
+	}
+
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			flush()
+		case c == '(' || c == ')' || c == ',' || c == '*' || c == ';' || c == '=':
+			flush()
+			tokens = append(tokens, string(c))
+		case (c == '>' || c == '<') && i+1 < len(sql) && sql[i+1] == '=':
+			flush()
+			tokens = append(tokens, sql[i:i+2])
+			i++
+		default:
+			word.WriteByte(c)
+		}
+	}
+	flush()
+	return tokens
+}
+
+// Match a column name case-insensitively
+func columnName(name string) (string, error) {
+	for _, column := range []string{ColumnTconst, ColumnAverageRating, ColumnNumVotes} {
+		if strings.EqualFold(name, column) {
+			if column == ColumnTconst {
+				return "", fmt.Errorf("%w: %v is not a numeric column", ErrSyntax, column)
+			}
+			return column, nil
+		}
+	}
+	return "", fmt.Errorf("%w: unknown column %q", ErrSyntax, name)
+}
+
+// Largest value a column can hold
+func maxValue(column string) float64 {
+	if column == ColumnNumVotes {
+		return float64(^uint32(0))
+	}
+	return 6553.5 // AverageRating is stored as uint16 * 10
+}
@@ -0,0 +1,245 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Plan How a statement is answered
+type Plan struct {
+	UseIndex  bool         // Range scan on the indexes, otherwise full scan of the disk
+	IndexOnly bool         // COUNT answered from the index alone, without reading data blocks
+	Ranges    []IndexRange // Index ranges read, if UseIndex
+	Union     bool         // Predicates are joined by OR, the addresses of the ranges are unioned instead of intersected
+	Filters   []Predicate  // Predicates checked on every fetched record
+
+	// Cost estimates in number of blocks (index nodes + data blocks) read
+	EstimatedRows float64
+	IndexCost     float64 // -1 if no index can be used
+	ScanCost      float64 // Blocks not ruled out by their zone map
+}
+
+// IndexRange Key range read from the index on Column
+type IndexRange struct {
+	Column  string
+	FromKey uint32
+	ToKey   uint32
+	Pred    Predicate // Predicate the range was built from
+
+	// Estimates, see indexCost
+	rows  float64
+	nodes float64
+}
+
+func (rng IndexRange) String() string {
+	return fmt.Sprintf("%v [%v, %v]", rng.Column, rng.Pred.From, rng.Pred.To)
+}
+
+func (plan Plan) String() string {
+	ranges := make([]string, len(plan.Ranges))
+	for i, rng := range plan.Ranges {
+		ranges[i] = rng.String()
+	}
+
+	var s string
+	switch {
+	case plan.IndexOnly:
+		s = fmt.Sprintf("index-only count on %v", ranges[0])
+	case plan.UseIndex && len(ranges) == 1:
+		s = fmt.Sprintf("index scan on %v", ranges[0])
+	case plan.UseIndex && plan.Union:
+		s = fmt.Sprintf("index union of %v", strings.Join(ranges, " and "))
+	case plan.UseIndex:
+		s = fmt.Sprintf("index intersection of %v", strings.Join(ranges, " and "))
+	default:
+		s = "full table scan"
+	}
+
+	if plan.IndexCost < 0 {
+		return fmt.Sprintf("%v (full scan cost: %.0f)", s, plan.ScanCost)
+	}
+	return fmt.Sprintf("%v (estimated rows: %.0f, index scan cost: %.0f, full scan cost: %.0f)",
+		s, plan.EstimatedRows, plan.IndexCost, plan.ScanCost)
+}
+
+// Plan the statement, indexes are only used when they're estimated to read fewer blocks than a full scan
+// With AND, the cheapest of a single index scan and the intersection of all indexed ranges is picked
+// With OR, the indexes can only be used when every predicate is indexed, their ranges are unioned
+func (table *Table) plan(stmt *Statement) Plan {
+	plan := Plan{
+		Union:     stmt.Or,
+		IndexCost: -1,
+		ScanCost:  table.scanCost(stmt),
+		Filters:   stmt.Where,
+	}
+
+	// First predicate on every indexed column
+	var candidates []IndexRange
+	indexed := map[string]bool{}
+	for _, pred := range stmt.Where {
+		if table.Indexes[pred.Column] == nil || indexed[pred.Column] {
+			continue
+		}
+		indexed[pred.Column] = true
+
+		rng := IndexRange{Column: pred.Column, Pred: pred}
+		rng.FromKey, rng.ToKey = keyRange(pred)
+		rng.rows, rng.nodes = table.indexCost(rng)
+		candidates = append(candidates, rng)
+	}
+
+	if len(candidates) == 0 || (stmt.Or && len(candidates) < len(stmt.Where)) {
+		return plan
+	}
+
+	if stmt.Or {
+		rows, nodes := 0.0, 0.0
+		for _, rng := range candidates {
+			rows += rng.rows
+			nodes += rng.nodes
+		}
+		rows = math.Min(rows, table.recordCount())
+		plan.choose(candidates, rows, nodes+table.dataBlocks(rows), nil)
+	} else {
+		// Single index scans
+		for _, rng := range candidates {
+			plan.choose([]IndexRange{rng}, rng.rows, rng.nodes+table.dataBlocks(rng.rows), filtersExcept(stmt.Where, rng.Pred))
+		}
+	}
+
+	// Intersection, with the predicates assumed independent
+	if !stmt.Or && len(candidates) > 1 {
+		total := table.recordCount()
+		rows, nodes := total, 0.0
+		filters := stmt.Where
+		for _, rng := range candidates {
+			if total > 0 {
+				rows *= rng.rows / total
+			}
+			nodes += rng.nodes
+			filters = filtersExcept(filters, rng.Pred)
+		}
+		plan.choose(candidates, rows, nodes+table.dataBlocks(rows), filters)
+	}
+
+	// Counting the records of the key range only needs the index, unless it also holds ended versions
+	rng := candidates[0]
+	countOnly := stmt.Aggregate == "COUNT" && (stmt.Column == "" || stmt.Column == rng.Column)
+	if countOnly && len(stmt.Where) == 1 && !stmt.GroupBy && table.Disk.EndedVersions() == 0 {
+		plan.Ranges = candidates
+		plan.Filters = nil
+		plan.EstimatedRows = rng.rows
+		plan.IndexOnly = true
+		plan.IndexCost = rng.nodes
+	}
+
+	plan.UseIndex = plan.IndexOnly || plan.IndexCost < plan.ScanCost
+	if !plan.UseIndex {
+		plan.Filters = stmt.Where
+	}
+	return plan
+}
+
+// Keep the index ranges if they are the cheapest so far
+func (plan *Plan) choose(ranges []IndexRange, rows float64, cost float64, filters []Predicate) {
+	if plan.IndexCost >= 0 && cost >= plan.IndexCost {
+		return
+	}
+	plan.Ranges = ranges
+	plan.EstimatedRows = rows
+	plan.IndexCost = cost
+	plan.Filters = filters
+}
+
+// Remove a predicate from the filters
+func filtersExcept(filters []Predicate, pred Predicate) []Predicate {
+	var rest []Predicate
+	removed := false
+	for _, filter := range filters {
+		if !removed && filter == pred {
+			removed = true
+			continue
+		}
+		rest = append(rest, filter)
+	}
+	return rest
+}
+
+// Estimate the rows and the number of index nodes read by an index range scan
+// Index nodes read = nodes from root to leaf + further leaf pages
+func (table *Table) indexCost(rng IndexRange) (rows float64, indexNodes float64) {
+	stats := table.stats[rng.Column]
+	if stats == nil {
+		return 0, 0
+	}
+	if rng.FromKey > rng.ToKey {
+		return 0, float64(stats.height)
+	}
+
+	rows, distinct := stats.hist.Estimate(float64(rng.FromKey), float64(rng.ToKey))
+
+	// Leaf pages, with keys spread evenly over the leaves
+	_, totalDistinct := stats.hist.Estimate(0, math.MaxUint32)
+	leafPages := 1.0
+	if stats.leaves > 0 && totalDistinct > 0 {
+		keysPerLeaf := totalDistinct / float64(stats.leaves)
+		leafPages = math.Max(1, math.Ceil(distinct/keysPerLeaf))
+	}
+
+	return rows, float64(stats.height-1) + leafPages
+}
+
+// Count the blocks a full scan reads, the zone maps are in memory so this is exact
+func (table *Table) scanCost(stmt *Statement) float64 {
+	blocks := 0
+	for _, block := range table.Disk.Blocks {
+		if zoneMatch(block.Zone, stmt.Where, stmt.Or) {
+			blocks++
+		}
+	}
+	return float64(blocks)
+}
+
+// Estimate the data blocks holding rows records scattered over the disk (Cardenas' formula)
+func (table *Table) dataBlocks(rows float64) float64 {
+	blocks := float64(len(table.Disk.Blocks))
+	if blocks == 0 {
+		return 0
+	}
+	return blocks * (1 - math.Pow(1-1/blocks, rows))
+}
+
+// Number of records in the table, from the statistics
+func (table *Table) recordCount() float64 {
+	stats := table.stats[ColumnNumVotes]
+	if stats == nil {
+		return 0
+	}
+	return float64(stats.hist.Total)
+}
+
+// Convert a predicate into a key range of the index on its column, see indexKey
+func keyRange(pred Predicate) (uint32, uint32) {
+	from := math.Ceil(pred.From)
+	to := math.Floor(pred.To)
+
+	if pred.Column == ColumnAverageRating {
+		// Ratings have 1 decimal place, keyed from 1
+		from = math.Ceil(pred.From*10-1e-9) + 1
+		to = math.Floor(pred.To*10+1e-9) + 1
+	}
+
+	if from < 1 {
+		// NumVotes can't be zero
+		from = 1
+	}
+	if to > math.MaxUint32 {
+		to = math.MaxUint32
+	}
+	if to < from {
+		// Empty range
+		return 1, 0
+	}
+	return uint32(from), uint32(to)
+}
@@ -0,0 +1,499 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"internal/bptree"
+	"internal/fs"
+	"strings"
+)
+
+// Table A VirtualDisk with B+ tree indexes, NumVotes is always indexed
+type Table struct {
+	Name    string
+	Disk    *fs.VirtualDisk
+	Indexes map[string]*bptree.BPTree // Index per column
+
+	order int // Order of the index trees
+
+	// Statistics for the planner, refreshed by Analyze
+	stats map[string]*indexStats
+}
+
+// Planner statistics of an index
+type indexStats struct {
+	hist   *Histogram // Histogram on the index keys
+	leaves int        // Number of leaf nodes in the index
+	height int        // Height of the index
+}
+
+// Number of histogram buckets kept per index
+const histogramBuckets = 100
+
+// Result of a statement, with the number of index nodes and data blocks accessed
+type Result struct {
+	Kind           StatementKind
+	Plan           Plan
+	Rows           []fs.Record
+	Aggregate      string  // Aggregate label, e.g. AVG(averageRating), empty for SELECT *
+	Value          float64 // Aggregate value
+	Groups         []Group // Aggregates per rating bucket, with GROUP BY
+	Deleted        int     // Number of records deleted
+	NodesAccessed  int
+	BlocksAccessed int
+	BlocksSkipped  int // Blocks a full scan skipped by their zone map
+}
+
+// NewTable Build the NumVotes index of order over the records on disk
+func NewTable(name string, disk *fs.VirtualDisk, order int) (*Table, error) {
+	table := &Table{
+		Name:    name,
+		Disk:    disk,
+		Indexes: map[string]*bptree.BPTree{},
+		order:   order,
+	}
+	if err := table.CreateIndex(ColumnNumVotes); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// CreateIndex Build a secondary index on column over the records on disk
+// Later inserts and deletes through the table keep every index in sync
+func (table *Table) CreateIndex(column string) error {
+	if column != ColumnNumVotes && column != ColumnAverageRating {
+		return fmt.Errorf("can't index column %q", column)
+	}
+
+	tree := bptree.New(table.order)
+	scanner := table.Disk.Scan(nil)
+	for scanner.Next() {
+		if err := tree.Insert(indexKey(scanner.Record(), column), scanner.Addr()); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	table.Indexes[column] = tree
+	table.Analyze()
+	return nil
+}
+
+// Insert Write a record to disk and add it to every index
+func (table *Table) Insert(record *fs.Record) (*byte, error) {
+	addr, err := table.Disk.WriteRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	for column, tree := range table.Indexes {
+		if err := tree.Insert(indexKey(*record, column), addr); err != nil {
+			return nil, err
+		}
+	}
+	return addr, nil
+}
+
+// Delete Remove the record at addr from every index and from disk
+func (table *Table) Delete(addr *byte) error {
+	record, err := fs.AddrToRecord(table.Disk, addr)
+	if err != nil {
+		return err
+	}
+	for column, tree := range table.Indexes {
+		if err := tree.DeleteRecord(indexKey(record, column), addr); err != nil {
+			return err
+		}
+	}
+	return table.Disk.DeleteRecord(addr)
+}
+
+// Compact Compact the disk, and move the index entries of the records it moved
+func (table *Table) Compact() error {
+	moved, err := table.Disk.Compact()
+	if err != nil {
+		return err
+	}
+
+	// Remove every old entry before adding the new ones, as a new address may be the old address of another record
+	records := map[*byte]fs.Record{}
+	for old, addr := range moved {
+		record, err := fs.ReadVersion(table.Disk, addr) // Ended versions move too
+		if err != nil {
+			return err
+		}
+		records[addr] = record
+		for column, tree := range table.Indexes {
+			if err := tree.DeleteRecord(indexKey(record, column), old); err != nil {
+				return err
+			}
+		}
+	}
+	for addr, record := range records {
+		for column, tree := range table.Indexes {
+			if err := tree.Insert(indexKey(record, column), addr); err != nil {
+				return err
+			}
+		}
+	}
+
+	table.Analyze()
+	return nil
+}
+
+// Analyze Refresh the statistics used by the planner
+func (table *Table) Analyze() {
+	values := map[string][]float64{}
+	scanner := table.Disk.Scan(nil)
+	for scanner.Next() {
+		for column := range table.Indexes {
+			values[column] = append(values[column], float64(indexKey(scanner.Record(), column)))
+		}
+	}
+
+	table.stats = map[string]*indexStats{}
+	for column, tree := range table.Indexes {
+		table.stats[column] = &indexStats{
+			hist:   NewHistogram(values[column], histogramBuckets),
+			leaves: tree.GetTotalLeaves(),
+			height: tree.GetHeight(),
+		}
+	}
+}
+
+// Key of a record in the index on column
+// AverageRating is keyed by rating * 10 + 1, as key 0 marks an empty slot in the tree
+func indexKey(record fs.Record, column string) uint32 {
+	if column == ColumnNumVotes {
+		return record.NumVotes
+	}
+	return uint32(record.AverageRating*10+0.5) + 1
+}
+
+// Run Parse and execute a statement
+func (table *Table) Run(sql string) (*Result, error) {
+	stmt, err := Parse(sql)
+	if err != nil {
+		return nil, err
+	}
+	return table.Execute(stmt)
+}
+
+// Execute a parsed statement against the table
+func (table *Table) Execute(stmt *Statement) (*Result, error) {
+	if stmt.Table != "" && !strings.EqualFold(stmt.Table, table.Name) {
+		return nil, fmt.Errorf("unknown table %q", stmt.Table)
+	}
+
+	plan := table.plan(stmt)
+	result := &Result{Kind: stmt.Kind, Plan: plan}
+
+	if stmt.Kind == Delete {
+		err := table.deleteRows(plan, result)
+		table.Analyze()
+		return result, err
+	}
+
+	if plan.IndexOnly {
+		table.indexCount(stmt, plan, result)
+		return result, nil
+	}
+
+	if plan.UseIndex {
+		if err := table.indexScan(plan, result); err != nil {
+			return nil, err
+		}
+	} else {
+		table.fullScan(plan, result)
+	}
+
+	if stmt.Aggregate != "" {
+		aggregate(stmt, result)
+	}
+	return result, nil
+}
+
+// Get the addresses of the records in the index ranges of the plan
+// Multiple ranges are intersected, or unioned for OR, before any data block is read
+func (table *Table) indexAddrs(plan Plan) ([]*byte, int) {
+	var lists [][]*byte
+	nodes := 0
+	for _, rng := range plan.Ranges {
+		if rng.FromKey > rng.ToKey {
+			lists = append(lists, nil)
+			continue
+		}
+		tree := table.Indexes[rng.Column]
+		lists = append(lists, tree.SearchRange(rng.FromKey, rng.ToKey, false))
+		nodes += tree.NodesAccessed
+	}
+	if len(lists) == 1 {
+		return lists[0], nodes
+	}
+
+	// Every record appears at most once per range
+	seen := map[*byte]int{}
+	for _, list := range lists {
+		for _, addr := range list {
+			seen[addr]++
+		}
+	}
+
+	var addrs []*byte
+	for _, list := range lists {
+		for _, addr := range list {
+			if plan.Union && seen[addr] > 0 {
+				addrs = append(addrs, addr)
+				seen[addr] = 0
+			} else if !plan.Union && seen[addr] == len(lists) {
+				addrs = append(addrs, addr)
+			}
+		}
+		if !plan.Union {
+			// All intersected records are in the first list
+			break
+		}
+	}
+	return addrs, nodes
+}
+
+// Fetch the records of the index ranges, and filter them
+func (table *Table) indexScan(plan Plan, result *Result) error {
+	addrs, nodes := table.indexAddrs(plan)
+	result.NodesAccessed = nodes
+
+	accessed := map[int]bool{}
+	for _, addr := range addrs {
+		accessed[table.Disk.LuTable[addr].BlockIndex] = true
+		record, err := fs.AddrToRecord(table.Disk, addr)
+		if errors.Is(err, fs.ErrRecordNotVisible) {
+			// Ended version, indexed for the readers before it ended
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if match(record, plan.Filters, false) {
+			result.Rows = append(result.Rows, record)
+		}
+	}
+	result.BlocksAccessed = len(accessed)
+	return nil
+}
+
+// Count the records of the index range from the index alone
+func (table *Table) indexCount(stmt *Statement, plan Plan, result *Result) {
+	result.Aggregate = "COUNT(*)"
+	if stmt.Column != "" {
+		result.Aggregate = fmt.Sprintf("COUNT(%v)", stmt.Column)
+	}
+	rng := plan.Ranges[0]
+	if rng.FromKey > rng.ToKey {
+		return
+	}
+
+	tree := table.Indexes[rng.Column]
+	result.Value = float64(tree.CountRange(rng.FromKey, rng.ToKey))
+	result.NodesAccessed = tree.NodesAccessed
+}
+
+// Read every block on disk that may hold a match according to its zone map, and filter the records
+func (table *Table) fullScan(plan Plan, result *Result) {
+	scanner := table.scan(plan)
+	for scanner.Next() {
+		result.Rows = append(result.Rows, scanner.Record())
+	}
+	result.BlocksAccessed = scanner.Stats.BlocksRead
+	result.BlocksSkipped = scanner.Stats.BlocksSkipped
+}
+
+func (table *Table) scan(plan Plan) *fs.Scanner {
+	return table.Disk.ScanZones(func(zone fs.ZoneMap) bool {
+		return zoneMatch(zone, plan.Filters, plan.Union)
+	}, func(record fs.Record) bool {
+		return match(record, plan.Filters, plan.Union)
+	})
+}
+
+// Delete the matching records from every index and the disk
+func (table *Table) deleteRows(plan Plan, result *Result) error {
+	if plan.UseIndex && len(plan.Ranges) == 1 && len(plan.Filters) == 0 {
+		return table.deleteRange(plan.Ranges[0], result)
+	}
+
+	var addrs []*byte
+	if plan.UseIndex {
+		var candidates []*byte
+		candidates, result.NodesAccessed = table.indexAddrs(plan)
+
+		accessed := map[int]bool{}
+		for _, addr := range candidates {
+			accessed[table.Disk.LuTable[addr].BlockIndex] = true
+			record, err := fs.AddrToRecord(table.Disk, addr)
+			if errors.Is(err, fs.ErrRecordNotVisible) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if match(record, plan.Filters, false) {
+				addrs = append(addrs, addr)
+			}
+		}
+		result.BlocksAccessed = len(accessed)
+	} else {
+		scanner := table.scan(plan)
+		for scanner.Next() {
+			addrs = append(addrs, scanner.Addr())
+		}
+		result.BlocksAccessed = scanner.Stats.BlocksRead
+		result.BlocksSkipped = scanner.Stats.BlocksSkipped
+	}
+
+	for _, addr := range addrs {
+		if err := table.Delete(addr); err != nil {
+			return err
+		}
+		result.Deleted++
+	}
+	return nil
+}
+
+// Delete a whole key range at once from its index, then remove the records from the other indexes and the disk
+// The records are fetched first, so that an error leaves the table untouched.
+func (table *Table) deleteRange(rng IndexRange, result *Result) error {
+	if rng.FromKey > rng.ToKey {
+		return nil
+	}
+
+	tree := table.Indexes[rng.Column]
+	candidates := tree.SearchRange(rng.FromKey, rng.ToKey, false)
+	result.NodesAccessed = tree.NodesAccessed
+
+	var addrs []*byte
+	var records []fs.Record
+	accessed := map[int]bool{}
+	for _, addr := range candidates {
+		accessed[table.Disk.LuTable[addr].BlockIndex] = true
+		record, err := fs.AddrToRecord(table.Disk, addr)
+		if errors.Is(err, fs.ErrRecordNotVisible) {
+			// Ended version, it stays indexed for the readers before it ended until Vacuum drops it
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+		records = append(records, record)
+	}
+	result.BlocksAccessed = len(accessed)
+
+	// The range can only be dropped at once if it holds no ended version
+	whole := len(addrs) == len(candidates)
+	if whole {
+		if _, err := tree.DeleteRange(rng.FromKey, rng.ToKey); err != nil {
+			return err
+		}
+	}
+	for i, addr := range addrs {
+		for column, other := range table.Indexes {
+			if column == rng.Column && whole {
+				continue
+			}
+			if err := other.DeleteRecord(indexKey(records[i], column), addr); err != nil {
+				return err
+			}
+		}
+		if err := table.Disk.DeleteRecord(addr); err != nil {
+			return err
+		}
+		result.Deleted++
+	}
+	return nil
+}
+
+// Compute the aggregate of the statement over the matched rows
+func aggregate(stmt *Statement, result *Result) {
+	column := stmt.Column
+	switch {
+	case column == "":
+		result.Aggregate = fmt.Sprintf("%v(*)", stmt.Aggregate)
+		column = ColumnNumVotes // Any column, for COUNT(*)
+	case stmt.Aggregate == "PERCENTILE":
+		result.Aggregate = fmt.Sprintf("%v(%v, %v)", stmt.Aggregate, column, stmt.Percentile)
+	default:
+		result.Aggregate = fmt.Sprintf("%v(%v)", stmt.Aggregate, column)
+	}
+
+	if stmt.GroupBy {
+		result.Groups = GroupByRating(result.Rows, column, 1)
+		for i := range result.Groups {
+			result.Groups[i].Value = stmt.aggregateValue(&result.Groups[i].Aggregates)
+		}
+	}
+
+	agg := Aggregate(result.Rows, column)
+	result.Value = stmt.aggregateValue(&agg)
+}
+
+// Pick the aggregate of the statement
+func (stmt *Statement) aggregateValue(agg *Aggregates) float64 {
+	switch stmt.Aggregate {
+	case "COUNT":
+		return float64(agg.Count)
+	case "SUM":
+		return agg.Sum
+	case "AVG":
+		return agg.Avg
+	case "MIN":
+		return agg.Min
+	case "MAX":
+		return agg.Max
+	case "STDDEV":
+		return agg.Stddev
+	case "PERCENTILE":
+		return agg.Percentile(stmt.Percentile)
+	}
+	return 0
+}
+
+// Check a record against all predicates, or against any of them if or is set
+func match(record fs.Record, preds []Predicate, or bool) bool {
+	for _, pred := range preds {
+		value := columnValue(record, pred.Column)
+		matched := value >= pred.From && value <= pred.To
+		if matched == or {
+			return or
+		}
+	}
+	return !or || len(preds) == 0
+}
+
+// Check if a block with the zone map can hold a record matching the predicates, see match
+func zoneMatch(zone fs.ZoneMap, preds []Predicate, or bool) bool {
+	for _, pred := range preds {
+		low, high := float64(zone.MinNumVotes), float64(zone.MaxNumVotes)
+		if pred.Column == ColumnAverageRating {
+			low, high = roundRating(zone.MinRating), roundRating(zone.MaxRating)
+		}
+		matched := high >= pred.From && low <= pred.To
+		if matched == or {
+			return or
+		}
+	}
+	return !or || len(preds) == 0
+}
+
+func columnValue(record fs.Record, column string) float64 {
+	if column == ColumnNumVotes {
+		return float64(record.NumVotes)
+	}
+	return roundRating(record.AverageRating)
+}
+
+// Round to the stored precision of 1 decimal place, so that float32 noise doesn't affect comparisons
+func roundRating(rating float32) float64 {
+	return float64(int(rating*10+0.5)) / 10
+}
@@ -0,0 +1,14 @@
+module txn
+
+go 1.19
+
+require (
+	internal/bptree v1.0.0
+	internal/fs v1.0.0
+)
+
+require github.com/grailbio/base v0.0.10 // indirect
+
+replace internal/fs => ../fs
+
+replace internal/bptree => ../bptree
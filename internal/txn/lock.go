@@ -0,0 +1,380 @@
+package txn
+
+import (
+	"errors"
+	"fmt"
+	"internal/bptree"
+	"sync"
+	"time"
+)
+
+// Lock manager
+// Records are locked within their block: a transaction takes an intention lock on the block before locking a record,
+// so that a lock on the whole block conflicts with the locks on its records.
+// Index keys are locked with next-key locking: a range scan locks the keys it reads and the gaps between them,
+// a gap being locked through the key following it, or past the last key. Inserting or deleting a key locks the gaps
+// around it, so the rows of a running scan can't appear or disappear.
+// A request conflicting with the locks held waits for them in line. A request closing a cycle in the waits-for graph
+// fails with ErrDeadlock, and a request waiting longer than Timeout with ErrLockTimeout.
+
+var (
+	ErrDeadlock    = errors.New("lock request would deadlock")
+	ErrLockTimeout = errors.New("lock request timed out")
+)
+
+// DefaultTimeout Longest wait for a lock of a new manager
+const DefaultTimeout = 5 * time.Second
+
+// LockMode Mode of a lock, see compatible
+type LockMode int
+
+const (
+	IntentionShared    LockMode = iota // Shared locks are taken on items within
+	IntentionExclusive                 // Exclusive locks are taken on items within
+	Shared
+	Exclusive
+)
+
+func (mode LockMode) String() string {
+	return [...]string{"IS", "IX", "S", "X"}[mode]
+}
+
+// Check whether locks in modes a and b can be held together by different transactions
+func compatible(a LockMode, b LockMode) bool {
+	switch {
+	case a == Exclusive || b == Exclusive:
+		return false
+	case a == IntentionShared || b == IntentionShared:
+		return true
+	default:
+		return a == b
+	}
+}
+
+// Mode of a lock held in mode a, then requested in mode b by the same transaction
+func combine(a LockMode, b LockMode) LockMode {
+	switch {
+	case a == b || b == IntentionShared:
+		return a
+	case a == IntentionShared:
+		return b
+	default:
+		// No mode holds both S and IX, X covers them
+		return Exclusive
+	}
+}
+
+type resourceKind int
+
+const (
+	recordResource resourceKind = iota
+	blockResource
+	keyResource
+	gapResource
+)
+
+// Past the last key of a tree, for the gap after it
+const supremum = uint64(1) << 32
+
+// Resource Item locked by a transaction
+type Resource struct {
+	kind  resourceKind
+	addr  *byte
+	block int
+	tree  *bptree.BPTree
+	key   uint64
+}
+
+// RecordResource The record at addr
+func RecordResource(addr *byte) Resource {
+	return Resource{kind: recordResource, addr: addr}
+}
+
+// BlockResource Block index of the disk
+func BlockResource(index int) Resource {
+	return Resource{kind: blockResource, block: index}
+}
+
+// KeyResource The records of key in tree, whether there are any or not
+func KeyResource(tree *bptree.BPTree, key uint32) Resource {
+	return Resource{kind: keyResource, tree: tree, key: uint64(key)}
+}
+
+// GapResource The keys missing from tree below next, the key following them
+func GapResource(tree *bptree.BPTree, next uint32) Resource {
+	return Resource{kind: gapResource, tree: tree, key: uint64(next)}
+}
+
+// Gap after the last key of tree
+func lastGap(tree *bptree.BPTree) Resource {
+	return Resource{kind: gapResource, tree: tree, key: supremum}
+}
+
+// Gap of tree holding key, which isn't in the tree
+func gapOf(tree *bptree.BPTree, key uint32) Resource {
+	if next, ok := tree.NextKey(key); ok {
+		return GapResource(tree, next)
+	}
+	return lastGap(tree)
+}
+
+func (r Resource) String() string {
+	switch r.kind {
+	case recordResource:
+		return fmt.Sprintf("record %v", r.addr)
+	case blockResource:
+		return fmt.Sprintf("block %v", r.block)
+	case keyResource:
+		return fmt.Sprintf("key %v", r.key)
+	}
+	if r.key == supremum {
+		return "gap after the last key"
+	}
+	return fmt.Sprintf("gap below key %v", r.key)
+}
+
+// LockStats Lock requests of a lock manager
+type LockStats struct {
+	Granted   int
+	Waits     int // Requests that had to wait, whatever their outcome
+	Deadlocks int
+	Timeouts  int
+}
+
+// LockManager Shared/exclusive locks of the running transactions, see Lock
+type LockManager struct {
+	Timeout time.Duration // Longest wait for a lock, 0 to wait for as long as it takes
+	Stats   LockStats
+
+	mu      sync.Mutex
+	locks   map[Resource]*lock
+	held    map[*Txn][]Resource // Resources locked by every transaction
+	waiting map[*Txn]*request   // Request every waiting transaction waits on
+}
+
+type lock struct {
+	holders map[*Txn]LockMode
+	queue   []*request // Requests waiting, first come first served
+}
+
+type request struct {
+	tx       *Txn
+	resource Resource
+	mode     LockMode
+	ready    chan struct{} // Closed once granted
+}
+
+// NewLockManager Create a lock manager without any lock
+func NewLockManager(timeout time.Duration) *LockManager {
+	return &LockManager{
+		Timeout: timeout,
+		locks:   map[Resource]*lock{},
+		held:    map[*Txn][]Resource{},
+		waiting: map[*Txn]*request{},
+	}
+}
+
+// Lock Lock r in mode for tx, waiting for the conflicting locks to be released
+// A lock already held by tx is upgraded. Return ErrDeadlock if tx would wait on a transaction waiting on it,
+// ErrLockTimeout if the lock isn't granted within Timeout. Either way tx should be aborted.
+func (manager *LockManager) Lock(tx *Txn, r Resource, mode LockMode) error {
+	manager.mu.Lock()
+	if manager.tryLock(tx, r, mode) {
+		manager.mu.Unlock()
+		return nil
+	}
+
+	req := &request{tx: tx, resource: r, mode: mode, ready: make(chan struct{})}
+	l := manager.locks[r]
+	if _, holds := l.holders[tx]; holds {
+		// Upgrades go first, the requests in line may be waiting on tx
+		l.queue = append([]*request{req}, l.queue...)
+	} else {
+		l.queue = append(l.queue, req)
+	}
+	manager.waiting[tx] = req
+	manager.Stats.Waits++
+	if manager.deadlocked(tx) {
+		manager.dequeue(req)
+		manager.Stats.Deadlocks++
+		manager.mu.Unlock()
+		return fmt.Errorf("%w: transaction %v on %v", ErrDeadlock, tx.ID, r)
+	}
+	manager.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if manager.Timeout > 0 {
+		timer := time.NewTimer(manager.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-req.ready:
+		return nil
+	case <-timeout:
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	select {
+	case <-req.ready:
+		// Granted while timing out
+		return nil
+	default:
+	}
+	manager.dequeue(req)
+	manager.grantWaiting(r)
+	manager.Stats.Timeouts++
+	return fmt.Errorf("%w: transaction %v on %v after %v", ErrLockTimeout, tx.ID, r, manager.Timeout)
+}
+
+// TryLock Lock r in mode for tx if it can be granted right away, see Lock
+func (manager *LockManager) TryLock(tx *Txn, r Resource, mode LockMode) bool {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	return manager.tryLock(tx, r, mode)
+}
+
+// ReleaseAll Release every lock held by tx, and grant the requests waiting on them
+func (manager *LockManager) ReleaseAll(tx *Txn) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	for _, r := range manager.held[tx] {
+		l := manager.locks[r]
+		delete(l.holders, tx)
+		manager.grantWaiting(r)
+		if len(l.holders) == 0 && len(l.queue) == 0 {
+			delete(manager.locks, r)
+		}
+	}
+	delete(manager.held, tx)
+}
+
+// Grant the lock if no other transaction holds a conflicting lock or waits before tx, the manager is locked
+func (manager *LockManager) tryLock(tx *Txn, r Resource, mode LockMode) bool {
+	l, exist := manager.locks[r]
+	if !exist {
+		l = &lock{holders: map[*Txn]LockMode{}}
+		manager.locks[r] = l
+	}
+
+	held, holds := l.holders[tx]
+	if holds {
+		// Upgrades don't wait in line, they'd wait on themselves
+		mode = combine(held, mode)
+		if mode == held {
+			return true
+		}
+	} else if len(l.queue) > 0 {
+		return false
+	}
+	if !manager.grantable(l, tx, mode) {
+		return false
+	}
+
+	l.holders[tx] = mode
+	if !holds {
+		manager.held[tx] = append(manager.held[tx], r)
+	}
+	manager.Stats.Granted++
+	return true
+}
+
+// Check whether the holders of l other than tx are compatible with mode
+func (manager *LockManager) grantable(l *lock, tx *Txn, mode LockMode) bool {
+	for holder, held := range l.holders {
+		if holder != tx && !compatible(held, mode) {
+			return false
+		}
+	}
+	return true
+}
+
+// Grant the requests waiting on r in line, until one has to keep waiting
+func (manager *LockManager) grantWaiting(r Resource) {
+	l, exist := manager.locks[r]
+	if !exist {
+		return
+	}
+	for len(l.queue) > 0 {
+		req := l.queue[0]
+		held, holds := l.holders[req.tx]
+		mode := req.mode
+		if holds {
+			mode = combine(held, mode)
+		}
+		if !manager.grantable(l, req.tx, mode) {
+			return
+		}
+
+		l.queue = l.queue[1:]
+		delete(manager.waiting, req.tx)
+		l.holders[req.tx] = mode
+		if !holds {
+			manager.held[req.tx] = append(manager.held[req.tx], r)
+		}
+		manager.Stats.Granted++
+		close(req.ready)
+	}
+}
+
+// Remove req from the requests waiting on its resource
+func (manager *LockManager) dequeue(req *request) {
+	l := manager.locks[req.resource]
+	for i, r := range l.queue {
+		if r == req {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			break
+		}
+	}
+	delete(manager.waiting, req.tx)
+	if len(l.holders) == 0 && len(l.queue) == 0 {
+		delete(manager.locks, req.resource)
+	}
+}
+
+// Transactions the waiting transaction tx waits on
+// It waits on the holders of a conflicting lock, and on the conflicting requests before it in line.
+func (manager *LockManager) waitsFor(tx *Txn) []*Txn {
+	req := manager.waiting[tx]
+	if req == nil {
+		return nil
+	}
+
+	var txs []*Txn
+	l := manager.locks[req.resource]
+	for holder, held := range l.holders {
+		if holder != tx && !compatible(held, req.mode) {
+			txs = append(txs, holder)
+		}
+	}
+	for _, r := range l.queue {
+		if r == req {
+			break
+		}
+		if r.tx != tx && !compatible(r.mode, req.mode) {
+			txs = append(txs, r.tx)
+		}
+	}
+	return txs
+}
+
+// Check whether tx waits on itself through the waits-for graph
+func (manager *LockManager) deadlocked(tx *Txn) bool {
+	visited := map[*Txn]bool{}
+	stack := manager.waitsFor(tx)
+	for len(stack) > 0 {
+		next := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if next == tx {
+			return true
+		}
+		if visited[next] {
+			continue
+		}
+		visited[next] = true
+		stack = append(stack, manager.waitsFor(next)...)
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package txn
+
+import (
+	"errors"
+	"internal/fs"
+	"testing"
+	"time"
+)
+
+func newTestManager(t *testing.T) *Manager {
+	t.Helper()
+	vd, err := fs.NewVirtualDisk(1, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(&vd)
+}
+
+// Wait until tx waits on a lock
+func waitForRequest(t *testing.T, locks *LockManager, tx *Txn) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		locks.mu.Lock()
+		req := locks.waiting[tx]
+		locks.mu.Unlock()
+		if req != nil {
+			return
+		}
+	}
+	t.Fatalf("transaction %v isn't waiting", tx.ID)
+}
+
+func TestLockCompatibility(t *testing.T) {
+	manager := newTestManager(t)
+	locks := manager.Locks
+	tx1, tx2 := manager.Begin(), manager.Begin()
+	r := BlockResource(0)
+
+	if !locks.TryLock(tx1, r, IntentionExclusive) || !locks.TryLock(tx2, r, IntentionShared) {
+		t.Fatal("IX and IS aren't compatible")
+	}
+	if locks.TryLock(tx2, r, Shared) {
+		t.Error("S granted while IX is held")
+	}
+	locks.ReleaseAll(tx1)
+	if !locks.TryLock(tx2, r, Shared) {
+		t.Error("S not granted once IX is released")
+	}
+	if locks.TryLock(tx1, r, IntentionExclusive) {
+		t.Error("IX granted while S is held")
+	}
+}
+
+func TestLockUpgrade(t *testing.T) {
+	manager := newTestManager(t)
+	locks := manager.Locks
+	tx1, tx2 := manager.Begin(), manager.Begin()
+	r := BlockResource(0)
+
+	if !locks.TryLock(tx1, r, Shared) || !locks.TryLock(tx2, r, Shared) {
+		t.Fatal("S and S aren't compatible")
+	}
+	done := make(chan error)
+	go func() {
+		done <- locks.Lock(tx1, r, Exclusive)
+	}()
+	waitForRequest(t, locks, tx1)
+	locks.ReleaseAll(tx2)
+	if err := <-done; err != nil {
+		t.Fatalf("upgrade failed: %v", err)
+	}
+	if locks.TryLock(tx2, r, IntentionShared) {
+		t.Error("IS granted while X is held")
+	}
+}
+
+func TestLockDeadlock(t *testing.T) {
+	manager := newTestManager(t)
+	locks := manager.Locks
+	tx1, tx2 := manager.Begin(), manager.Begin()
+	a, b := BlockResource(0), BlockResource(1)
+
+	if err := locks.Lock(tx1, a, Exclusive); err != nil {
+		t.Fatal(err)
+	}
+	if err := locks.Lock(tx2, b, Exclusive); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- locks.Lock(tx1, b, Exclusive)
+	}()
+	waitForRequest(t, locks, tx1)
+
+	if err := locks.Lock(tx2, a, Exclusive); !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("closing the cycle got %v, want ErrDeadlock", err)
+	}
+	if err := tx2.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("tx1 wasn't granted once tx2 aborted: %v", err)
+	}
+	if locks.Stats.Deadlocks != 1 {
+		t.Errorf("got %v deadlocks, want 1", locks.Stats.Deadlocks)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	manager := newTestManager(t)
+	locks := manager.Locks
+	locks.Timeout = 20 * time.Millisecond
+	tx1, tx2 := manager.Begin(), manager.Begin()
+	r := BlockResource(0)
+
+	if err := locks.Lock(tx1, r, Exclusive); err != nil {
+		t.Fatal(err)
+	}
+	if err := locks.Lock(tx2, r, Shared); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("got %v, want ErrLockTimeout", err)
+	}
+	locks.ReleaseAll(tx1)
+	if !locks.TryLock(tx2, r, Shared) {
+		t.Error("S not granted once X is released")
+	}
+}
@@ -0,0 +1,314 @@
+// Package txn contains transactions over a VirtualDisk and its indexes, isolated by strict two-phase locking
+package txn
+
+import (
+	"errors"
+	"fmt"
+	"internal/bptree"
+	"internal/fs"
+	"sync"
+)
+
+// Every write is applied as soon as it's made and logged with its undo, Abort undoes the log in reverse.
+// Locks are taken before reading or writing a record, a block or index keys, and held until Commit or Abort,
+// so no transaction reads what another one hasn't committed yet, see LockManager.
+
+var ErrTxnDone = errors.New("transaction is already committed or aborted")
+
+// Stats Outcome of the transactions of a manager
+type Stats struct {
+	Committed int
+	Aborted   int
+}
+
+// Manager Start transactions over a disk, and serialise their access to it
+// The disk and the trees passed to the transactions must only be written through the manager.
+type Manager struct {
+	Disk  *fs.VirtualDisk
+	Locks *LockManager
+	Stats Stats
+
+	mu     sync.Mutex // Guards the disk and the trees
+	nextID uint64
+}
+
+type state int
+
+const (
+	active state = iota
+	committed
+	aborted
+)
+
+// Txn Transaction started by Manager.Begin
+// A transaction getting ErrDeadlock or ErrLockTimeout should be aborted, and may be retried.
+type Txn struct {
+	ID uint64
+
+	manager *Manager
+	state   state
+	undo    []func() error // Undo of every write, in the order they were made
+}
+
+// Lock needed by an operation
+type lockRequest struct {
+	resource Resource
+	mode     LockMode
+}
+
+// New Create a transaction manager over disk, waiting DefaultTimeout at most for a lock
+func New(disk *fs.VirtualDisk) *Manager {
+	return &Manager{
+		Disk:  disk,
+		Locks: NewLockManager(DefaultTimeout),
+	}
+}
+
+// Begin Start a transaction
+func (manager *Manager) Begin() *Txn {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	manager.nextID++
+	return &Txn{ID: manager.nextID, manager: manager}
+}
+
+// Run op once tx holds the locks listed by need, with the manager locked
+// A lock that isn't granted right away is waited for with the manager unlocked, then the locks are listed again
+// as the keys they depend on may have changed meanwhile.
+func (tx *Txn) run(need func() []lockRequest, op func() error) error {
+	manager := tx.manager
+	for {
+		manager.mu.Lock()
+		if tx.state != active {
+			manager.mu.Unlock()
+			return ErrTxnDone
+		}
+
+		requests := need()
+		blocked := -1
+		for i, req := range requests {
+			if !manager.Locks.TryLock(tx, req.resource, req.mode) {
+				blocked = i
+				break
+			}
+		}
+		if blocked < 0 {
+			err := op()
+			manager.mu.Unlock()
+			return err
+		}
+		manager.mu.Unlock()
+
+		req := requests[blocked]
+		if err := manager.Locks.Lock(tx, req.resource, req.mode); err != nil {
+			return err
+		}
+	}
+}
+
+// Locks of the record at addr and of its block in mode
+func (tx *Txn) recordLocks(addr *byte, mode LockMode) []lockRequest {
+	intention := IntentionShared
+	if mode == Exclusive {
+		intention = IntentionExclusive
+	}
+	var requests []lockRequest
+	if loc, exist := tx.manager.Disk.LuTable[addr]; exist {
+		requests = append(requests, lockRequest{BlockResource(loc.BlockIndex), intention})
+	}
+	return append(requests, lockRequest{RecordResource(addr), mode})
+}
+
+// Read Read the record at addr
+// Return fs.ErrRecordNotVisible if addr holds an ended version, which Search and SearchRange leave out.
+func (tx *Txn) Read(addr *byte) (fs.Record, error) {
+	var record fs.Record
+	err := tx.run(func() []lockRequest {
+		return tx.recordLocks(addr, Shared)
+	}, func() error {
+		var err error
+		record, err = fs.AddrToRecord(tx.manager.Disk, addr)
+		return err
+	})
+	return record, err
+}
+
+// ReadBlock Read the records of block index, see fs.BlockToRecords
+func (tx *Txn) ReadBlock(index int) ([]fs.Record, []*byte, error) {
+	var records []fs.Record
+	var pointers []*byte
+	err := tx.run(func() []lockRequest {
+		return []lockRequest{{BlockResource(index), Shared}}
+	}, func() error {
+		disk := tx.manager.Disk
+		if index < 0 || index >= len(disk.Blocks) {
+			return fmt.Errorf("block %v is out of the disk", index)
+		}
+		records, pointers = fs.BlockToRecords(disk.Blocks[index])
+		return nil
+	})
+	return records, pointers, err
+}
+
+// WriteRecord Write record into the disk, see VirtualDisk.WriteRecord
+// The block and the slot receiving the record are locked before it's written.
+func (tx *Txn) WriteRecord(record *fs.Record) (*byte, error) {
+	var addr *byte
+	err := tx.run(func() []lockRequest {
+		index, slot := tx.manager.Disk.NextRecordSlot()
+		requests := []lockRequest{{BlockResource(index), IntentionExclusive}}
+		if slot != nil {
+			// The slot may be reused while the transaction which deleted its record still holds its lock
+			requests = append(requests, lockRequest{RecordResource(slot), Exclusive})
+		}
+		return requests
+	}, func() error {
+		disk := tx.manager.Disk
+		var err error
+		if addr, err = disk.WriteRecord(record); err != nil {
+			return err
+		}
+		// The slot of a new block is new too, nobody else holds a lock on it
+		tx.manager.Locks.TryLock(tx, RecordResource(addr), Exclusive)
+		tx.undo = append(tx.undo, func() error {
+			return disk.DeleteRecord(addr)
+		})
+		return nil
+	})
+	return addr, err
+}
+
+// Search Get the addresses of the records of key in tree
+func (tx *Txn) Search(tree *bptree.BPTree, key uint32) ([]*byte, error) {
+	var addrs []*byte
+	err := tx.run(func() []lockRequest {
+		return []lockRequest{{KeyResource(tree, key), Shared}}
+	}, func() error {
+		addrs = tx.current(tree.Search(key, false))
+		return nil
+	})
+	return addrs, err
+}
+
+// Drop the addresses of ended versions, the index keeps them for the readers before they ended
+// A transaction reads the current version of every record.
+func (tx *Txn) current(addrs []*byte) []*byte {
+	var current []*byte
+	for _, addr := range addrs {
+		if record, err := fs.ReadVersion(tx.manager.Disk, addr); err == nil && record.End != 0 {
+			continue
+		}
+		current = append(current, addr)
+	}
+	return current
+}
+
+// SearchRange Get the addresses of the records with key in [fromKey, toKey] in tree
+// The keys in range and the gaps between them are locked, so a transaction can't add a key in range meanwhile.
+func (tx *Txn) SearchRange(tree *bptree.BPTree, fromKey uint32, toKey uint32) ([]*byte, error) {
+	var addrs []*byte
+	err := tx.run(func() []lockRequest {
+		var requests []lockRequest
+		key, ok := fromKey, len(tree.Search(fromKey, false)) > 0
+		if !ok {
+			key, ok = tree.NextKey(fromKey)
+		}
+		for ok && key <= toKey {
+			requests = append(requests, lockRequest{GapResource(tree, key), Shared}, lockRequest{KeyResource(tree, key), Shared})
+			key, ok = tree.NextKey(key)
+		}
+		return append(requests, lockRequest{gapOf(tree, toKey), Shared})
+	}, func() error {
+		addrs = tx.current(tree.SearchRange(fromKey, toKey, false))
+		return nil
+	})
+	return addrs, err
+}
+
+// Insert Add key pointing to the record at addr into tree, see BPTree.Insert
+func (tx *Txn) Insert(tree *bptree.BPTree, key uint32, addr *byte) error {
+	return tx.run(func() []lockRequest {
+		if len(tree.Search(key, false)) > 0 {
+			return []lockRequest{{KeyResource(tree, key), Exclusive}}
+		}
+		return keyChangeLocks(tree, key)
+	}, func() error {
+		if err := tree.Insert(key, addr); err != nil {
+			return err
+		}
+		tx.undo = append(tx.undo, func() error {
+			return tree.DeleteRecord(key, addr)
+		})
+		return nil
+	})
+}
+
+// Locks of adding or removing key from tree
+// A new key splits its gap in two, the gap below it and the gap above it, and removing it merges them back.
+func keyChangeLocks(tree *bptree.BPTree, key uint32) []lockRequest {
+	return []lockRequest{{KeyResource(tree, key), Exclusive}, {GapResource(tree, key), Exclusive}, {gapOf(tree, key), Exclusive}}
+}
+
+// Delete Remove key and all its records from tree, see BPTree.Delete
+func (tx *Txn) Delete(tree *bptree.BPTree, key uint32) error {
+	return tx.run(func() []lockRequest {
+		return keyChangeLocks(tree, key)
+	}, func() error {
+		addrs := tree.Search(key, false)
+		if err := tree.Delete(key); err != nil {
+			return err
+		}
+		tx.undo = append(tx.undo, func() error {
+			for _, addr := range addrs {
+				if err := tree.Insert(key, addr); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		return nil
+	})
+}
+
+// Commit Make the writes of the transaction visible to the others, and release its locks
+func (tx *Txn) Commit() error {
+	manager := tx.manager
+	manager.mu.Lock()
+	if tx.state != active {
+		manager.mu.Unlock()
+		return ErrTxnDone
+	}
+	tx.state = committed
+	tx.undo = nil
+	manager.Stats.Committed++
+	manager.mu.Unlock()
+
+	manager.Locks.ReleaseAll(tx)
+	return nil
+}
+
+// Abort Undo the writes of the transaction, and release its locks
+// Every undo is attempted, the first error is returned.
+func (tx *Txn) Abort() error {
+	manager := tx.manager
+	manager.mu.Lock()
+	if tx.state != active {
+		manager.mu.Unlock()
+		return ErrTxnDone
+	}
+
+	var first error
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		if err := tx.undo[i](); err != nil && first == nil {
+			first = fmt.Errorf("undoing transaction %v: %w", tx.ID, err)
+		}
+	}
+	tx.state = aborted
+	tx.undo = nil
+	manager.Stats.Aborted++
+	manager.mu.Unlock()
+
+	manager.Locks.ReleaseAll(tx)
+	return first
+}
@@ -0,0 +1,123 @@
+package txn
+
+import (
+	"errors"
+	"internal/bptree"
+	"internal/fs"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAbortUndoesWrites(t *testing.T) {
+	manager := newTestManager(t)
+	tree := bptree.New(4)
+
+	tx := manager.Begin()
+	addr, err := tx.WriteRecord(&fs.Record{Tconst: "tt1", AverageRating: 5, NumVotes: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Insert(tree, 10, addr); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Abort(); err != nil {
+		t.Fatal(err)
+	}
+
+	if found := tree.Search(10, false); len(found) != 0 {
+		t.Errorf("key 10 has %v records after abort", len(found))
+	}
+	if _, err = fs.AddrToRecord(manager.Disk, addr); !errors.Is(err, fs.ErrRecordNotFound) {
+		t.Errorf("record read after abort got %v, want ErrRecordNotFound", err)
+	}
+	if err = tx.Commit(); !errors.Is(err, ErrTxnDone) {
+		t.Errorf("commit after abort got %v, want ErrTxnDone", err)
+	}
+}
+
+// Run transactions inserting, deleting and scanning keys concurrently, the committed ones must be all that's left
+// and no scan may see its rows change
+func TestConcurrentTransactions(t *testing.T) {
+	manager := newTestManager(t)
+	manager.Locks.Timeout = 200 * time.Millisecond
+	tree := bptree.New(5)
+
+	var mu sync.Mutex
+	committed := map[uint32]int{}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for i := 0; i < 100; i++ {
+				tx := manager.Begin()
+				counts := map[uint32]int{} // Records of the keys written, as the transaction sees them
+				var err error
+				for op := 0; op < 4 && err == nil; op++ {
+					key := uint32(rng.Intn(40) + 1)
+					switch rng.Intn(3) {
+					case 0:
+						var addr *byte
+						if addr, err = tx.WriteRecord(&fs.Record{Tconst: "tt1", AverageRating: 5, NumVotes: key}); err != nil {
+							break
+						}
+						var found []*byte
+						if found, err = tx.Search(tree, key); err != nil {
+							break
+						}
+						if err = tx.Insert(tree, key, addr); err == nil {
+							counts[key] = len(found) + 1
+						}
+					case 1:
+						if err = tx.Delete(tree, key); err == nil {
+							counts[key] = 0
+						} else if errors.Is(err, bptree.ErrKeyNotFound) {
+							err = nil
+						}
+					case 2:
+						var first, second []*byte
+						if first, err = tx.SearchRange(tree, key, key+10); err != nil {
+							break
+						}
+						time.Sleep(50 * time.Microsecond)
+						if second, err = tx.SearchRange(tree, key, key+10); err == nil && len(first) != len(second) {
+							t.Errorf("transaction %v: scan of [%v, %v] went from %v to %v rows", tx.ID, key, key+10, len(first), len(second))
+						}
+					}
+				}
+
+				if err != nil && !errors.Is(err, ErrDeadlock) && !errors.Is(err, ErrLockTimeout) {
+					t.Errorf("transaction %v: %v", tx.ID, err)
+				}
+				if err != nil || rng.Intn(4) == 0 {
+					if err = tx.Abort(); err != nil {
+						t.Errorf("transaction %v: abort: %v", tx.ID, err)
+					}
+					continue
+				}
+				// The keys written are still locked, no other transaction can commit them meanwhile
+				mu.Lock()
+				for key, count := range counts {
+					committed[key] = count
+				}
+				mu.Unlock()
+				if err = tx.Commit(); err != nil {
+					t.Errorf("transaction %v: commit: %v", tx.ID, err)
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+
+	for key := uint32(1); key <= 40; key++ {
+		if got := len(tree.Search(key, false)); got != committed[key] {
+			t.Errorf("key %v has %v records, want %v", key, got, committed[key])
+		}
+	}
+	if manager.Stats.Committed == 0 {
+		t.Error("no transaction committed")
+	}
+}
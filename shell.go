@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"internal/bptree"
+	"internal/fs"
+	"internal/query"
+	"os"
+	"strings"
+)
+
+// Interactive query shell over the ratings table
+// go run shell.go -data ./data/data.tsv -block 200
+func main() {
+	dataPath := flag.String("data", "./data/data.tsv", "Path of the tsv data file")
+	blockSize := flag.Int("block", 200, "Block size in bytes")
+	clustered := flag.Bool("clustered", false, "Store the records sorted by numVotes")
+	flag.Parse()
+
+	vd, err := fs.NewVirtualDisk(100, *blockSize)
+	if err != nil {
+		fmt.Printf("Error creating virtual disk: %v\n", err)
+		return
+	}
+	err = vd.LoadRecords(*dataPath)
+	if err != nil {
+		fmt.Printf("Error loading records: %v\n", err)
+		return
+	}
+	if *clustered {
+		err = vd.Cluster()
+		if err != nil {
+			fmt.Printf("Error clustering records: %v\n", err)
+			return
+		}
+	}
+
+	treeOrder := bptree.OrderForBlockSize(vd.BlockSize, bptree.KeySize, bptree.PtrSize, bptree.HeaderSize)
+	fmt.Println("Building indexes on numVotes and averageRating...")
+	table, err := query.NewTable("ratings", &vd, treeOrder)
+	if err != nil {
+		fmt.Printf("Error building index: %v\n", err)
+		return
+	}
+	err = table.CreateIndex(query.ColumnAverageRating)
+	if err != nil {
+		fmt.Printf("Error building index: %v\n", err)
+		return
+	}
+
+	fmt.Println("Type a query, or 'exit' to quit. e.g.")
+	fmt.Println("  SELECT * FROM ratings WHERE numVotes BETWEEN 30000 AND 40000")
+	fmt.Println("  SELECT AVG(averageRating) FROM ratings WHERE numVotes = 500")
+	fmt.Println("  SELECT * FROM ratings WHERE numVotes >= 1000 AND averageRating >= 9")
+	fmt.Println("  SELECT COUNT(*) FROM ratings WHERE averageRating = 10 OR numVotes >= 100000")
+	fmt.Println("  SELECT PERCENTILE(numVotes, 90) FROM ratings GROUP BY averageRating")
+	fmt.Println("  DELETE FROM ratings WHERE numVotes = 1000")
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("sql> ")
+		if !scanner.Scan() {
+			break
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line == "exit" || line == "quit" {
+			break
+		}
+
+		result, err := table.Run(line)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			continue
+		}
+		printResult(result)
+	}
+}
+
+func printResult(result *query.Result) {
+	fmt.Printf("Plan: %v\n", result.Plan)
+
+	if result.Aggregate != "" {
+		for _, group := range result.Groups {
+			fmt.Printf("averageRating [%.1f, %.1f): %v = %v (%v records)\n",
+				group.Low, group.High, result.Aggregate, group.Value, group.Count)
+		}
+		fmt.Printf("%v: %v\n", result.Aggregate, result.Value)
+	} else if result.Kind == query.Delete {
+		fmt.Printf("Records deleted: %v\n", result.Deleted)
+	} else {
+		for i, record := range result.Rows {
+			if i == 20 {
+				fmt.Printf("... %v more\n", len(result.Rows)-i)
+				break
+			}
+			fmt.Printf("%v\n", record)
+		}
+		fmt.Printf("Records returned: %v\n", len(result.Rows))
+	}
+
+	fmt.Printf("Index nodes accessed: %v\n", result.NodesAccessed)
+	fmt.Printf("Data blocks accessed: %v\n", result.BlocksAccessed)
+	if !result.Plan.UseIndex {
+		fmt.Printf("Data blocks skipped by zone maps: %v\n", result.BlocksSkipped)
+	}
+}